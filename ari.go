@@ -0,0 +1,228 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/pebble/v2/acme"
+	"github.com/letsencrypt/pebble/v2/db"
+)
+
+// DefaultRenewalInfoRetryAfter is the default duration clients are asked to
+// wait before checking a certificate's renewal information again.
+const DefaultRenewalInfoRetryAfter = 6 * time.Hour
+
+// RenewalInfo is the ACME Renewal Information (ARI) provided for a
+// certificate.
+//
+// https://datatracker.ietf.org/doc/draft-ietf-acme-ari/
+type RenewalInfo struct {
+	// SuggestedWindowStart is the start of the window in which the
+	// certificate should be renewed.
+	SuggestedWindowStart time.Time
+	// SuggestedWindowEnd is the end of the window in which the certificate
+	// should be renewed.
+	SuggestedWindowEnd time.Time
+	// ExplanationURL optionally points at a page explaining the suggested
+	// window, eg: for a mass revocation event.
+	ExplanationURL string
+	// RetryAfter is the duration clients should wait before checking the
+	// renewal information again, DefaultRenewalInfoRetryAfter is used when
+	// unset.
+	RetryAfter time.Duration
+}
+
+// renewalInfoResponse is the renewalInfo resource.
+type renewalInfoResponse struct {
+	SuggestedWindow struct {
+		Start string `json:"start"`
+		End   string `json:"end"`
+	} `json:"suggestedWindow"`
+	ExplanationURL string `json:"explanationURL,omitempty"`
+}
+
+// ARICertID provides the ARI certificate identifier for the certificate: its
+// base64url encoded AKI key identifier and serial number, joined by a period.
+// The serial number is encoded as the content of its DER INTEGER, so serials
+// with the high bit set have a leading zero byte.
+func ARICertID(cert *x509.Certificate) string {
+	var serial asn1.RawValue
+	if der, err := asn1.Marshal(cert.SerialNumber); err == nil {
+		// tag and length are stripped, leaving the content.
+		asn1.Unmarshal(der, &serial)
+	}
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial.Bytes)
+}
+
+// parseARISerial parses the serial number from the content of its DER INTEGER,
+// as encoded in ARI certificate identifiers.
+func parseARISerial(content []byte) (*big.Int, error) {
+	der, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagInteger, Bytes: content})
+	if err != nil {
+		return nil, err
+	}
+	serial := new(big.Int)
+	if _, err := asn1.Unmarshal(der, &serial); err != nil {
+		return nil, err
+	}
+	return serial, nil
+}
+
+// renewalInfoService serves the renewalInfo resource, which Pebble (as of
+// v2.4.0) doesn't implement.
+type renewalInfoService struct {
+	db    *db.MemoryStore
+	clock *Clock
+
+	mu        sync.Mutex
+	overrides map[string]RenewalInfo
+}
+
+func newRenewalInfoService(store *db.MemoryStore, clock *Clock) *renewalInfoService {
+	return &renewalInfoService{
+		db:        store,
+		clock:     clock,
+		overrides: map[string]RenewalInfo{},
+	}
+}
+
+// Set overrides the renewal information for the certificate with the given
+// serial number.
+func (ri *renewalInfoService) Set(serial *big.Int, info RenewalInfo) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	ri.overrides[serial.Text(16)] = info
+}
+
+// Reset reverts to the default renewal information for the certificate with
+// the given serial number.
+func (ri *renewalInfoService) Reset(serial *big.Int) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	delete(ri.overrides, serial.Text(16))
+}
+
+// Lookup provides the renewal information for the certificate. By default,
+// renewal is suggested within the first half of the final third of the
+// certificate's lifetime and immediately for revoked certificates.
+func (ri *renewalInfoService) Lookup(cert *x509.Certificate) RenewalInfo {
+	ri.mu.Lock()
+	info, ok := ri.overrides[cert.SerialNumber.Text(16)]
+	ri.mu.Unlock()
+
+	if !ok {
+		if ri.db.GetRevokedCertificateBySerial(cert.SerialNumber) != nil {
+			now := ri.clock.Now()
+			info = RenewalInfo{
+				SuggestedWindowStart: now.Add(-time.Hour),
+				SuggestedWindowEnd:   now,
+			}
+		} else {
+			lifetime := cert.NotAfter.Sub(cert.NotBefore)
+			info = RenewalInfo{
+				SuggestedWindowStart: cert.NotAfter.Add(-lifetime / 3),
+				SuggestedWindowEnd:   cert.NotAfter.Add(-lifetime / 6),
+			}
+		}
+	}
+	if info.RetryAfter == 0 {
+		info.RetryAfter = DefaultRenewalInfoRetryAfter
+	}
+
+	return info
+}
+
+// ServeHTTP serves the renewalInfo resource for the certificate ID in the path.
+func (ri *renewalInfoService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendProblem(w, acme.MethodNotAllowed())
+		return
+	}
+
+	cert, prob := ri.certificate(strings.TrimPrefix(r.URL.Path, pebbleRenewalInfoPath))
+	if prob != nil {
+		sendProblem(w, prob)
+		return
+	}
+
+	info := ri.Lookup(cert)
+	var resp renewalInfoResponse
+	resp.SuggestedWindow.Start = info.SuggestedWindowStart.UTC().Format(time.RFC3339)
+	resp.SuggestedWindow.End = info.SuggestedWindowEnd.UTC().Format(time.RFC3339)
+	resp.ExplanationURL = info.ExplanationURL
+
+	body, err := marshalIndent(resp)
+	if err != nil {
+		sendProblem(w, acme.InternalErrorProblem("unable to marshal renewal info"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(int(info.RetryAfter.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// certificate finds the issued, or revoked, certificate by its ARI
+// certificate ID.
+func (ri *renewalInfoService) certificate(certID string) (*x509.Certificate, *acme.ProblemDetails) {
+	parts := strings.Split(certID, ".")
+	if len(parts) != 2 {
+		return nil, acme.MalformedProblem("certificate ID must be AKI and serial, separated by a period")
+	}
+	aki, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, acme.MalformedProblem("certificate ID AKI is not base64url encoded")
+	}
+	serialBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, acme.MalformedProblem("certificate ID serial is not base64url encoded")
+	}
+	serial, err := parseARISerial(serialBytes)
+	if err != nil {
+		return nil, acme.MalformedProblem("certificate ID serial is not a DER encoded integer")
+	}
+
+	var cert *x509.Certificate
+	if issued := ri.db.GetCertificateBySerial(serial); issued != nil {
+		cert = issued.Cert
+	} else if revoked := ri.db.GetRevokedCertificateBySerial(serial); revoked != nil {
+		cert = revoked.Certificate.Cert
+	}
+	if cert == nil || !bytes.Equal(cert.AuthorityKeyId, aki) {
+		return nil, acme.NotFoundProblem("unknown certificate")
+	}
+
+	return cert, nil
+}
+
+// SetRenewalInfo overrides the renewal information (ARI) provided for the
+// certificate.
+func (p Pebble) SetRenewalInfo(cert *x509.Certificate, info RenewalInfo) {
+	p.renewalInfo.Set(cert.SerialNumber, info)
+}
+
+// ResetRenewalInfo reverts to the default renewal information (ARI) provided
+// for the certificate.
+func (p Pebble) ResetRenewalInfo(cert *x509.Certificate) {
+	p.renewalInfo.Reset(cert.SerialNumber)
+}
+
+// RenewalInfo provides the renewal information (ARI) served for the
+// certificate.
+func (p Pebble) RenewalInfo(cert *x509.Certificate) RenewalInfo {
+	return p.renewalInfo.Lookup(cert)
+}
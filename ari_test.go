@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/letsencrypt/pebble/v2/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPebble_RenewalInfo(t *testing.T) {
+	pebble := SharedPebble()
+
+	resp, err := pebble.Client().Get(pebble.ACMEDirectoryURL())
+	require.NoError(t, err)
+	directory := map[string]interface{}{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&directory))
+	resp.Body.Close()
+	renewalInfoURL, ok := directory["renewalInfo"].(string)
+	require.True(t, ok, "should advertise renewalInfo")
+	assert.Equal(t, pebble.Server().URL+pebbleRenewalInfoPath, renewalInfoURL)
+
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+	resource, err := LegoClient(pebble, user).Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{"renewal-info.ari.test"},
+	})
+	require.NoError(t, err)
+	cert, err := certcrypto.ParsePEMCertificate(resource.Certificate)
+	require.NoError(t, err)
+
+	fetch := func(t *testing.T, certID string) (*http.Response, renewalInfoResponse) {
+		resp, err := pebble.Client().Get(renewalInfoURL + certID)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var info renewalInfoResponse
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+		}
+		return resp, info
+	}
+
+	t.Run("default", func(t *testing.T) {
+		resp, info := fetch(t, ARICertID(cert))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "21600", resp.Header.Get("Retry-After"))
+
+		expected := pebble.RenewalInfo(cert)
+		assert.Equal(t, expected.SuggestedWindowStart.UTC().Format(time.RFC3339), info.SuggestedWindow.Start)
+		assert.Equal(t, expected.SuggestedWindowEnd.UTC().Format(time.RFC3339), info.SuggestedWindow.End)
+		assert.True(t, expected.SuggestedWindowStart.After(cert.NotBefore))
+		assert.True(t, expected.SuggestedWindowEnd.Before(cert.NotAfter))
+	})
+
+	t.Run("override", func(t *testing.T) {
+		start := time.Now().Add(-time.Hour).Truncate(time.Second)
+		pebble.SetRenewalInfo(cert, RenewalInfo{
+			SuggestedWindowStart: start,
+			SuggestedWindowEnd:   start.Add(2 * time.Hour),
+			ExplanationURL:       "https://ari.test/incident",
+			RetryAfter:           time.Minute,
+		})
+		t.Cleanup(func() { pebble.ResetRenewalInfo(cert) })
+
+		resp, info := fetch(t, ARICertID(cert))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+		assert.Equal(t, start.UTC().Format(time.RFC3339), info.SuggestedWindow.Start)
+		assert.Equal(t, start.Add(2*time.Hour).UTC().Format(time.RFC3339), info.SuggestedWindow.End)
+		assert.Equal(t, "https://ari.test/incident", info.ExplanationURL)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		unknown := &x509.Certificate{AuthorityKeyId: []byte("not the issuer"), SerialNumber: cert.SerialNumber}
+
+		resp, _ := fetch(t, ARICertID(unknown))
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp, _ = fetch(t, "malformed")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestARICertID(t *testing.T) {
+	aki, err := hex.DecodeString("69885b6b87464041e1b37b847ba0ae2cde01c8d4")
+	require.NoError(t, err)
+	serial, ok := new(big.Int).SetString("87654321", 16)
+	require.True(t, ok)
+
+	// draft-ietf-acme-ari's example, its serial has the high bit set.
+	assert.Equal(t, "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE",
+		ARICertID(&x509.Certificate{AuthorityKeyId: aki, SerialNumber: serial}))
+
+	t.Run("lookup", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber:   serial,
+			AuthorityKeyId: aki,
+			NotBefore:      time.Now(),
+			NotAfter:       time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+
+		store := db.NewMemoryStore()
+		_, err = store.AddCertificate(coreCertificate(cert))
+		require.NoError(t, err)
+		ri := newRenewalInfoService(store, nil)
+
+		found, prob := ri.certificate(ARICertID(cert))
+		require.Nil(t, prob)
+		assert.Equal(t, serial, found.SerialNumber)
+
+		_, prob = ri.certificate("aYhba4dGQEHhs3uEe6CuLN4ByNQ.AACHZUMh")
+		require.NotNil(t, prob, "should reject non-minimal serial encoding")
+		assert.Equal(t, http.StatusBadRequest, prob.HTTPStatus)
+	})
+}
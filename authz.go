@@ -0,0 +1,413 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/pebble/v2/acme"
+	"github.com/letsencrypt/pebble/v2/core"
+	"github.com/letsencrypt/pebble/v2/db"
+)
+
+const (
+	// pebblePendingAuthzExpiry is the validity of Pebble's pending
+	// authorizations.
+	pebblePendingAuthzExpiry = time.Hour
+	// pebbleValidAuthzExpiry is the validity of authorizations validated by
+	// Pebble's VA.
+	pebbleValidAuthzExpiry = time.Hour
+)
+
+// AuthorizationReuse is whether an account's valid authorizations are reused
+// for the identifiers of its new orders.
+type AuthorizationReuse string
+
+const (
+	// AuthorizationReuseDefault reuses valid authorizations half of the time,
+	// as Pebble does.
+	AuthorizationReuseDefault AuthorizationReuse = ""
+	// AuthorizationReuseAlways reuses valid authorizations whenever there's
+	// one for the identifier.
+	AuthorizationReuseAlways AuthorizationReuse = "always"
+	// AuthorizationReuseNever creates new authorizations for every order.
+	AuthorizationReuseNever AuthorizationReuse = "never"
+)
+
+// authorizationService extends Pebble's authorizations with a configurable
+// validity period and reuse, and creates pre-authorizations.
+type authorizationService struct {
+	db      *db.MemoryStore
+	tracker *objectTracker
+	// validity is the period validated authorizations are valid for, Pebble's
+	// when 0.
+	validity time.Duration
+	// reuse is whether new orders reuse valid authorizations, Pebble decides
+	// at random when left as AuthorizationReuseDefault.
+	reuse            AuthorizationReuse
+	preauthorization bool
+
+	mu sync.Mutex
+	// adjusted are the IDs of authorizations given the validity period.
+	adjusted map[string]struct{}
+}
+
+func newAuthorizationService(store *db.MemoryStore, tracker *objectTracker, validity time.Duration, reuse AuthorizationReuse, preauthorization bool) *authorizationService {
+	return &authorizationService{
+		db:               store,
+		tracker:          tracker,
+		validity:         validity,
+		reuse:            reuse,
+		preauthorization: preauthorization,
+		adjusted:         map[string]struct{}{},
+	}
+}
+
+// WrapHandler serves newAuthz requests, decides the reuse of authorizations by
+// new orders, and gives validated authorizations the validity period before
+// each request is served.
+func (as *authorizationService) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if as.preauthorization && r.URL.Path == pebbleNewAuthzPath {
+			as.newAuthz(w, r, next)
+			return
+		}
+
+		as.adjustValidity()
+		if as.reuse != AuthorizationReuseDefault && r.Method == http.MethodPost && r.URL.Path == pebbleNewOrderPath {
+			as.newOrder(w, r, next)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newOrder has the order created by Pebble reuse the account's valid
+// authorizations, or not, in place of those Pebble chose at random.
+//
+// https://github.com/letsencrypt/pebble/blob/v2.4.0/wfe/wfe.go#L1502-L1505
+func (as *authorizationService) newOrder(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	rec := httptest.NewRecorder()
+	next.ServeHTTP(rec, r)
+
+	body := rec.Body.Bytes()
+	if rec.Code != http.StatusCreated {
+		writeRecorded(w, rec, body)
+		return
+	}
+	order := as.db.GetOrderByID(path.Base(rec.Header().Get("Location")))
+	if order == nil {
+		writeRecorded(w, rec, body)
+		return
+	}
+
+	changed, err := as.setAuthorizationReuse(r, order)
+	if err != nil {
+		sendProblem(w, acme.InternalErrorProblem(err.Error()))
+		return
+	}
+	if changed {
+		// the status is recomputed from the authorizations.
+		order = as.db.GetOrderByID(order.ID)
+		order.RLock()
+		authzURLs, status := order.Authorizations, order.Status
+		order.RUnlock()
+
+		doc := map[string]interface{}{}
+		if json.Unmarshal(body, &doc) == nil {
+			doc["authorizations"] = authzURLs
+			doc["status"] = status
+			if b, err := marshalIndent(doc); err == nil {
+				body = b
+			}
+		}
+	}
+
+	writeRecorded(w, rec, body)
+}
+
+// setAuthorizationReuse replaces the order's authorizations so that the
+// account's valid authorizations are always, or never, reused. Authorizations
+// Pebble reused are those created for other orders.
+func (as *authorizationService) setAuthorizationReuse(r *http.Request, order *core.Order) (bool, error) {
+	order.Lock()
+	defer order.Unlock()
+
+	var changed bool
+	for i, authz := range order.AuthorizationObjects {
+		authz.RLock()
+		reused, ident := authz.Order != order, authz.Identifier
+		authz.RUnlock()
+
+		var replacement *core.Authorization
+		switch {
+		case as.reuse == AuthorizationReuseAlways && !reused:
+			replacement = as.db.FindValidAuthorization(order.AccountID, ident)
+		case as.reuse == AuthorizationReuseNever && reused:
+			var err error
+			replacement, err = as.addAuthorization(r, order, ident)
+			if err != nil {
+				return false, err
+			}
+		}
+		if replacement == nil {
+			continue
+		}
+
+		replacement.RLock()
+		id := replacement.ID
+		replacement.RUnlock()
+		order.AuthorizationObjects[i] = replacement
+		order.Authorizations[i] = relativeEndpoint(r, pebbleAuthzPath+id)
+		changed = true
+	}
+	return changed, nil
+}
+
+// adjustValidity gives authorizations validated since last adjusted the
+// validity period, in place of Pebble's.
+func (as *authorizationService) adjustValidity() {
+	if as.validity == 0 {
+		return
+	}
+
+	var authzs []*core.Authorization
+	for _, id := range as.tracker.Orders() {
+		order := as.db.GetOrderByID(id)
+		if order == nil {
+			continue
+		}
+		order.RLock()
+		authzs = append(authzs, order.AuthorizationObjects...)
+		order.RUnlock()
+	}
+	authzs = append(authzs, as.tracker.Preauthorizations()...)
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	for _, authz := range authzs {
+		if _, done := as.adjusted[authz.ID]; done {
+			continue
+		}
+
+		authz.Lock()
+		if authz.Status == acme.StatusValid {
+			// the expiry is moved rather than set, keeping any shift made by
+			// the Clock.
+			authz.ExpiresDate = authz.ExpiresDate.Add(as.validity - pebbleValidAuthzExpiry)
+			authz.Expires = authz.ExpiresDate.UTC().Format(time.RFC3339)
+			as.adjusted[authz.ID] = struct{}{}
+		}
+		authz.Unlock()
+	}
+}
+
+// newAuthz creates a pending authorization for the requested identifier,
+// outside of any order.
+//
+// https://www.rfc-editor.org/rfc/rfc8555.html#section-7.4.1
+func (as *authorizationService) newAuthz(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if r.Method != http.MethodPost {
+		sendProblem(w, acme.MethodNotAllowed())
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendProblem(w, acme.MalformedProblem("unable to read request body"))
+		return
+	}
+
+	setReplayNonce(w, next)
+
+	account, payload := verifiedJWS(as.db, body)
+	if account == nil {
+		sendProblem(w, acme.MalformedProblem("JWS verification error"))
+		return
+	}
+	if prob := verifyNonceAndURL(r, body, next); prob != nil {
+		sendProblem(w, prob)
+		return
+	}
+	var req struct {
+		Identifier acme.Identifier `json:"identifier"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		sendProblem(w, acme.MalformedProblem("Error unmarshaling body JSON"))
+		return
+	}
+	if prob := preauthorizationIdentifierProblem(req.Identifier); prob != nil {
+		sendProblem(w, prob)
+		return
+	}
+
+	authz, err := as.createPreauthorization(r, account, req.Identifier)
+	if err != nil {
+		sendProblem(w, acme.InternalErrorProblem(err.Error()))
+		return
+	}
+
+	authz.RLock()
+	doc := authz.Authorization
+	for _, chal := range authz.Challenges {
+		doc.Challenges = append(doc.Challenges, chal.Challenge)
+	}
+	authzURL := authz.URL
+	authz.RUnlock()
+
+	resp, err := marshalIndent(doc)
+	if err != nil {
+		sendProblem(w, acme.InternalErrorProblem("Error marshaling authorization"))
+		return
+	}
+	w.Header().Set("Location", authzURL)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resp)
+}
+
+// preauthorizationIdentifierProblem provides the problem with pre-authorizing
+// the identifier, if any.
+func preauthorizationIdentifierProblem(ident acme.Identifier) *acme.ProblemDetails {
+	switch {
+	case ident.Type == acme.IdentifierDNS && strings.HasPrefix(ident.Value, "*."):
+		// https://www.rfc-editor.org/rfc/rfc8555.html#section-7.4.1
+		return acme.MalformedProblem("Wildcard identifiers cannot be pre-authorized")
+	case ident.Type == acme.IdentifierDNS && ident.Value != "":
+		return nil
+	case ident.Type == acme.IdentifierIP && net.ParseIP(ident.Value) != nil:
+		return nil
+	default:
+		return acme.MalformedProblem(fmt.Sprintf("Invalid identifier %s %q", ident.Type, ident.Value))
+	}
+}
+
+// createPreauthorization adds a pending authorization to the PebbleDB. Pebble
+// expects every authorization to belong to an order, the authorization is
+// given an order of its own that isn't added to the PebbleDB.
+func (as *authorizationService) createPreauthorization(r *http.Request, account *core.Account, ident acme.Identifier) (*core.Authorization, error) {
+	expires := time.Now().UTC().Add(pebblePendingAuthzExpiry)
+	order := &core.Order{
+		AccountID:   account.ID,
+		ExpiresDate: expires,
+		Order: acme.Order{
+			Status:      acme.StatusPending,
+			Expires:     expires.Format(time.RFC3339),
+			Identifiers: []acme.Identifier{ident},
+		},
+	}
+	authz, err := as.addAuthorization(r, order, ident)
+	if err != nil {
+		return nil, err
+	}
+	order.AuthorizationObjects = []*core.Authorization{authz}
+	order.Authorizations = []string{authz.URL}
+	as.tracker.trackPreauthorization(authz)
+
+	return authz, nil
+}
+
+// addAuthorization adds a pending authorization of the order for the
+// identifier, with challenges as Pebble creates them, to the PebbleDB.
+func (as *authorizationService) addAuthorization(r *http.Request, order *core.Order, ident acme.Identifier) (*core.Authorization, error) {
+	expires := time.Now().UTC().Add(pebblePendingAuthzExpiry)
+	authz := &core.Authorization{
+		ID:          newToken(),
+		ExpiresDate: expires,
+		Order:       order,
+		Authorization: acme.Authorization{
+			Status:     acme.StatusPending,
+			Identifier: ident,
+			Expires:    expires.Format(time.RFC3339),
+		},
+	}
+	authz.URL = relativeEndpoint(r, pebbleAuthzPath+authz.ID)
+
+	// https://github.com/letsencrypt/pebble/blob/v2.4.0/wfe/wfe.go#L1572-L1606
+	chalTypes := []string{acme.ChallengeHTTP01, acme.ChallengeTLSALPN01, acme.ChallengeDNS01}
+	if ident.Type == acme.IdentifierIP {
+		chalTypes = []string{acme.ChallengeHTTP01, acme.ChallengeTLSALPN01}
+	}
+	for _, chalType := range chalTypes {
+		id := newToken()
+		chal := &core.Challenge{
+			ID: id,
+			Challenge: acme.Challenge{
+				Type:   chalType,
+				Token:  newToken(),
+				URL:    relativeEndpoint(r, pebbleChallengePath+id),
+				Status: acme.StatusPending,
+			},
+			Authz: authz,
+		}
+		if _, err := as.db.AddChallenge(chal); err != nil {
+			return nil, err
+		}
+		authz.Challenges = append(authz.Challenges, chal)
+	}
+
+	if _, err := as.db.AddAuthorization(authz); err != nil {
+		return nil, err
+	}
+
+	return authz, nil
+}
+
+// newToken provides a random token for ACME object IDs and challenges, as
+// Pebble does.
+func newToken() string {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(fmt.Sprintf("cannot read random bytes: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// WithPebbleAuthorizationReuse has Pebble always, or never, reuse an account's
+// valid authorizations for the identifiers of its new orders. Pebble reuses
+// them half of the time by default.
+func WithPebbleAuthorizationReuse(reuse bool) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		pc.PebbleServerConfig.AuthorizationReuse = AuthorizationReuseNever
+		if reuse {
+			pc.PebbleServerConfig.AuthorizationReuse = AuthorizationReuseAlways
+		}
+		return nil
+	}
+}
+
+// WithPebbleAuthorizationValidityPeriod keeps validated authorizations valid
+// for the period, rather than Pebble's hour, eg: to reuse them for renewals.
+func WithPebbleAuthorizationValidityPeriod(period time.Duration) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		if period <= 0 {
+			return errors.New("authorization validity period must be positive")
+		}
+		pc.PebbleServerConfig.AuthorizationValidityPeriod = period
+		return nil
+	}
+}
+
+// WithPebblePreAuthorization exposes a `newAuthz` endpoint in the directory,
+// for clients to authorize identifiers ahead of ordering certificates for
+// them. Pre-authorizations are used by new orders as valid authorizations are,
+// see WithPebbleAuthorizationReuse.
+func WithPebblePreAuthorization() PebbleOption {
+	return func(pc *pebbleConfig) error {
+		pc.PebbleServerConfig.PreAuthorization = true
+		return nil
+	}
+}
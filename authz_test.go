@@ -0,0 +1,275 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	legoacme "github.com/go-acme/lego/v4/acme"
+	acmeapi "github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestPebble_AuthorizationReuse(t *testing.T) {
+	// validatedOrder creates an order for the name, validating its
+	// authorization if it's pending.
+	validatedOrder := func(t *testing.T, pebble Pebble, api *acmeapi.Core, name string) legoacme.Authorization {
+		order, err := api.Orders.New([]string{name})
+		require.NoError(t, err)
+		authz, err := api.Authorizations.Get(order.Authorizations[0])
+		require.NoError(t, err)
+		if authz.Status == legoacme.StatusPending {
+			validate(t, pebble, api, order.Authorizations[0])
+			authz, err = api.Authorizations.Get(order.Authorizations[0])
+			require.NoError(t, err)
+		}
+		return authz
+	}
+
+	t.Run("always", func(t *testing.T) {
+		const validity = 30 * 24 * time.Hour
+		pebble := NewPebble(NewTestingContext(t),
+			WithPebbleManualValidation(0),
+			WithPebbleAuthorizationReuse(true),
+			WithPebbleAuthorizationValidityPeriod(validity))
+		user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+		api := LegoAPIClient(pebble, user)
+
+		first := validatedOrder(t, pebble, api, "always.reuse.test")
+		assert.Equal(t, legoacme.StatusValid, first.Status)
+		assert.WithinDuration(t, time.Now().Add(validity), first.Expires, time.Minute,
+			"should be valid for the validity period")
+
+		for i := 0; i < 5; i++ {
+			authz := validatedOrder(t, pebble, api, "always.reuse.test")
+			assert.Equal(t, first.Expires, authz.Expires, "should reuse the valid authorization")
+		}
+		assert.Len(t, pebble.Authorizations(user.GetRegistration().URI), 1)
+	})
+
+	t.Run("never", func(t *testing.T) {
+		pebble := NewPebble(NewTestingContext(t),
+			WithPebbleManualValidation(0),
+			WithPebbleAuthorizationReuse(false))
+		user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+		api := LegoAPIClient(pebble, user)
+
+		for i := 0; i < 3; i++ {
+			validatedOrder(t, pebble, api, "never.reuse.test")
+		}
+		assert.Len(t, pebble.Authorizations(user.GetRegistration().URI), 3)
+	})
+
+	t.Run("invalid validity period", func(t *testing.T) {
+		assert.Panics(t, func() {
+			NewPebble(NewTestingContext(t), WithPebbleAuthorizationValidityPeriod(0))
+		})
+	})
+}
+
+func TestPebble_PreAuthorization(t *testing.T) {
+	pebble := NewPebble(NewTestingContext(t),
+		WithPebbleManualValidation(0),
+		WithPebbleAuthorizationReuse(true),
+		WithPebblePreAuthorization())
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+	api := LegoAPIClient(pebble, user)
+
+	var directory map[string]interface{}
+	resp, err := pebble.Client().Get(pebble.ACMEDirectoryURL())
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&directory))
+	resp.Body.Close()
+	require.Equal(t, pebble.Server().URL+pebbleNewAuthzPath, directory["newAuthz"])
+
+	resp, preauthz := postNewAuthz(t, pebble, user, Identifier{Type: "dns", Value: "pre.authz.test"})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, legoacme.StatusPending, preauthz.Status)
+	assert.Len(t, preauthz.Challenges, 3)
+	assert.Len(t, pebble.Authorizations(user.GetRegistration().URI), 1)
+
+	validate(t, pebble, api, resp.Header.Get("Location"))
+
+	order, err := api.Orders.New([]string{"pre.authz.test"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{resp.Header.Get("Location")}, order.Authorizations,
+		"should use the pre-authorization")
+	assert.Equal(t, legoacme.StatusReady, order.Status)
+
+	t.Run("ip", func(t *testing.T) {
+		resp, preauthz := postNewAuthz(t, pebble, user, Identifier{Type: "ip", Value: "127.0.0.1"})
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Len(t, preauthz.Challenges, 2, "should not offer dns-01")
+	})
+
+	t.Run("wildcard", func(t *testing.T) {
+		resp, _ := postNewAuthz(t, pebble, user, Identifier{Type: "dns", Value: "*.pre.authz.test"})
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("nonce", func(t *testing.T) {
+		nonce := newNonce(t, pebble)
+		ident := Identifier{Type: "dns", Value: "nonce.pre.authz.test"}
+		url := pebble.Server().URL + pebbleNewAuthzPath
+		for i := 0; i < 5; i++ {
+			// Pebble rejects some valid nonces too.
+			resp, _ := signedNewAuthz(t, pebble, user, ident, nonce, url)
+			if resp.StatusCode == http.StatusCreated {
+				break
+			}
+			nonce = newNonce(t, pebble)
+		}
+
+		resp, _ := signedNewAuthz(t, pebble, user, ident, nonce, url)
+		prob, err := ParseProblem(resp)
+		require.NoError(t, err)
+		assert.Equal(t, acmeErrorNS+"badNonce", prob.Type, "should reject replayed nonce")
+
+		resp, _ = signedNewAuthz(t, pebble, user, ident, "testacme", url)
+		prob, err = ParseProblem(resp)
+		require.NoError(t, err)
+		assert.Equal(t, acmeErrorNS+"badNonce", prob.Type, "should reject unknown nonce")
+	})
+
+	t.Run("url", func(t *testing.T) {
+		ident := Identifier{Type: "dns", Value: "url.pre.authz.test"}
+		for _, url := range []string{
+			pebble.Server().URL + pebbleNewOrderPath,
+			pebble.Server().URL + "/elsewhere",
+		} {
+			resp, _ := signedNewAuthz(t, pebble, user, ident, newNonce(t, pebble), url)
+			prob, err := ParseProblem(resp)
+			require.NoError(t, err)
+			if prob.Type == acmeErrorNS+"badNonce" {
+				continue
+			}
+			assert.Equal(t, acmeErrorNS+"malformed", prob.Type)
+			assert.Contains(t, prob.Detail, "'url' incorrect")
+		}
+		assert.Len(t, pebble.Orders(user.GetRegistration().URI), 1, "should not create orders")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		var directory map[string]interface{}
+		resp, err := SharedPebble().Client().Get(SharedPebble().ACMEDirectoryURL())
+		require.NoError(t, err)
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&directory))
+		resp.Body.Close()
+		assert.NotContains(t, directory, "newAuthz")
+	})
+}
+
+// validate validates the authorization's first challenge, with Pebble's manual
+// validation.
+func validate(t *testing.T, pebble Pebble, api *acmeapi.Core, authzURL string) {
+	t.Helper()
+
+	authz, err := api.Authorizations.Get(authzURL)
+	require.NoError(t, err)
+	chal := authz.Challenges[0]
+	require.NoError(t, pebble.ResolveChallenge(chal.Token, ValidationValid, nil))
+	_, err = api.Challenges.New(chal.URL)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		authz, err := api.Authorizations.Get(authzURL)
+		return err == nil && authz.Status == legoacme.StatusValid
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+// postNewAuthz requests a pre-authorization for the identifier, signed with
+// the user's account key. Requests are retried with a new nonce when Pebble
+// rejects the nonce, as clients do.
+func postNewAuthz(t *testing.T, pebble Pebble, user registration.User, ident Identifier) (*http.Response, legoacme.Authorization) {
+	t.Helper()
+
+	for i := 0; ; i++ {
+		resp, authz := signedNewAuthz(t, pebble, user, ident, newNonce(t, pebble), pebble.Server().URL+pebbleNewAuthzPath)
+		if i < 5 && resp.StatusCode == http.StatusBadRequest {
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			var prob Problem
+			if json.Unmarshal(body, &prob) == nil && prob.Type == acmeErrorNS+"badNonce" {
+				continue
+			}
+		}
+		return resp, authz
+	}
+}
+
+// signedNewAuthz posts the newAuthz request for the identifier, signed with
+// the user's account key and given the nonce and url headers.
+func signedNewAuthz(t *testing.T, pebble Pebble, user registration.User, ident Identifier, nonce, url string) (*http.Response, legoacme.Authorization) {
+	t.Helper()
+
+	payload, err := json.Marshal(map[string]Identifier{"identifier": ident})
+	require.NoError(t, err)
+	resp, body := signedPost(t, pebble, user, pebble.Server().URL+pebbleNewAuthzPath, payload, nonce, url)
+
+	var authz legoacme.Authorization
+	if resp.StatusCode == http.StatusCreated {
+		require.NoError(t, json.Unmarshal(body, &authz))
+	}
+	return resp, authz
+}
+
+// signedPost posts the payload to the endpoint, signed with the user's account
+// key and given the nonce and url headers, and provides the response and its
+// body. The response body is left readable, eg: for ParseProblem.
+func signedPost(t *testing.T, pebble Pebble, user registration.User, endpoint string, payload []byte, nonce, url string) (*http.Response, []byte) {
+	t.Helper()
+
+	resp, err := pebble.Client().Post(endpoint, "application/jose+json",
+		strings.NewReader(signedJWS(t, user, payload, nonce, url)))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return resp, body
+}
+
+// signedJWS provides the (flattened JSON) JWS of the payload, signed with the
+// user's account key and given the nonce and url headers.
+func signedJWS(t *testing.T, user registration.User, payload []byte, nonce, url string) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       user.GetPrivateKey(),
+	}, &jose.SignerOptions{
+		ExtraHeaders: map[jose.HeaderKey]interface{}{
+			"kid":   user.GetRegistration().URI,
+			"url":   url,
+			"nonce": nonce,
+		},
+	})
+	require.NoError(t, err)
+	jws, err := signer.Sign(payload)
+	require.NoError(t, err)
+
+	return jws.FullSerialize()
+}
+
+// newNonce provides a fresh anti-replay nonce from Pebble.
+func newNonce(t *testing.T, pebble Pebble) string {
+	t.Helper()
+
+	resp, err := pebble.Client().Head(pebble.Server().URL + pebbleNoncePath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	require.NotEmpty(t, nonce)
+	return nonce
+}
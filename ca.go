@@ -0,0 +1,744 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/pebble/v2/acme"
+	"github.com/letsencrypt/pebble/v2/core"
+	"github.com/letsencrypt/pebble/v2/db"
+)
+
+// Pebble doesn't accept CA key material of its own (as of v2.4.0), so testacme
+// re-issues the certificates vended by Pebble's CA using its own issuer when
+// callers bring their own keys (or seed) or configure the CA beyond what Pebble
+// supports, like subjects, key types and CRLs - see customCA. Pebble's issued
+// certificates are replaced in the PebbleDB as their orders are finalized,
+// before the finalize response is sent, so clients only ever see the
+// certificates (and serials) issued by the testacme managed chains.
+
+// issueTimeout bounds the wait for Pebble to issue a finalized order's
+// certificate, which it does in the background.
+const issueTimeout = 10 * time.Second
+
+var (
+	// oidIssuedExtensions are the extensions set on re-issued certificates from
+	// the template's fields, any others of the original are carried over as-is.
+	oidIssuedExtensions = []asn1.ObjectIdentifier{
+		{2, 5, 29, 14},              // subject key identifier
+		{2, 5, 29, 15},              // key usage
+		{2, 5, 29, 17},              // subject alternative name
+		{2, 5, 29, 19},              // basic constraints
+		{2, 5, 29, 31},              // CRL distribution points
+		{2, 5, 29, 35},              // authority key identifier
+		{2, 5, 29, 37},              // extended key usage
+		{1, 3, 6, 1, 5, 5, 7, 1, 1}, // authority information access
+	}
+
+	// deterministicNotBefore is the NotBefore used for CA certificates built
+	// from provided key material, keeping their content stable.
+	deterministicNotBefore = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	// deterministicNotAfter is the RFC 5280 "no well-defined expiration date"
+	// value, used for CA certificates built from provided key material.
+	deterministicNotAfter = time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC)
+)
+
+// CAKeyType is the key algorithm used for testacme CA keys.
+type CAKeyType string
+
+const (
+	// CAKeyRSA2048 uses 2048 bit RSA keys, as Pebble does.
+	CAKeyRSA2048 CAKeyType = "rsa-2048"
+	// CAKeyRSA4096 uses 4096 bit RSA keys.
+	CAKeyRSA4096 CAKeyType = "rsa-4096"
+	// CAKeyP256 uses ECDSA keys on the NIST P-256 curve.
+	CAKeyP256 CAKeyType = "p-256"
+	// CAKeyP384 uses ECDSA keys on the NIST P-384 curve.
+	CAKeyP384 CAKeyType = "p-384"
+	// CAKeyEd25519 uses Ed25519 keys.
+	CAKeyEd25519 CAKeyType = "ed25519"
+)
+
+// caKeys holds the CA key material provided with options.
+type caKeys struct {
+	// seed is used to derive any keys that aren't otherwise provided.
+	seed []byte
+	// root is the key for the (first) Root CA.
+	root crypto.Signer
+	// intermediate is the key for the leaf issuing Intermediate CA, shared by
+	// all chains.
+	intermediate crypto.Signer
+	// certs are the provided Root and Intermediate certificates, in that
+	// order.
+	certs []*x509.Certificate
+}
+
+// WithPebbleCAKeys uses the provided keys for the Root and (leaf issuing)
+// Intermediate CA. The Root and Intermediate certificates may also be given,
+// in that order, to use fixed CA certificates (eg: from testdata) - otherwise
+// the certificates are built from the keys with fixed validity periods.
+//
+// Keys for alternate chains and any additional intermediates are generated
+// with the same algorithm as the intermediate key, or derived when combined
+// with WithPebbleCASeed.
+func WithPebbleCAKeys(root, intermediate crypto.Signer, certs ...*x509.Certificate) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		if root == nil || intermediate == nil {
+			return errors.New("root and intermediate CA keys are required")
+		}
+		if len(certs) > 2 {
+			return fmt.Errorf("expected root and intermediate certificates, got %d certificates", len(certs))
+		}
+		if pc.caKeys == nil {
+			pc.caKeys = &caKeys{}
+		}
+		pc.caKeys.root = root
+		pc.caKeys.intermediate = intermediate
+		pc.caKeys.certs = certs
+		return nil
+	}
+}
+
+// WithPebbleCASeed derives all CA key material from the given seed. ECDSA P-256
+// keys are derived by default, their signatures (and so, CA certificates) vary
+// across runs while the keys themselves do not. Ed25519 keys may be derived
+// with CAKeyType for CA certificates that are identical across runs, though
+// OCSP responses can't be signed by them. Issued certificates are also given
+// serial numbers derived from their content.
+func WithPebbleCASeed(seed []byte) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		if len(seed) == 0 {
+			return errors.New("empty CA seed")
+		}
+		if pc.caKeys == nil {
+			pc.caKeys = &caKeys{}
+		}
+		pc.caKeys.seed = append([]byte(nil), seed...)
+		return nil
+	}
+}
+
+// issuerCert is a CA certificate and its key.
+type issuerCert struct {
+	key  crypto.Signer
+	cert *core.Certificate
+}
+
+// issuerChain is a single chain of CA certificates.
+type issuerChain struct {
+	root *issuerCert
+	// intermediates are ordered from the leaf issuer to the certificate issued
+	// by the root.
+	intermediates []*issuerCert
+}
+
+// issuer re-issues certificates vended by PebbleCA from testacme managed CA
+// key material.
+type issuer struct {
+	db     *db.MemoryStore
+	config PebbleServerConfig
+	chains []*issuerChain
+	// crlURLs are the CRL distribution points for issued leaves, when not
+	// configured otherwise.
+	crlURLs []string
+
+	mu sync.Mutex
+	// reissued are the testacme issued certificates by the ID of the
+	// certificate they replace, and by their own.
+	reissued map[string]*core.Certificate
+	serials  map[string]struct{}
+}
+
+// newIssuer builds the CA chains from the provided key material and CA
+// configuration.
+func newIssuer(store *db.MemoryStore, keys *caKeys, config PebbleServerConfig) (*issuer, error) {
+	if keys == nil {
+		keys = &caKeys{}
+	}
+
+	chainLength := config.CertificateChainLength
+	if chainLength < 1 {
+		// Pebble requires at least the one intermediate as well.
+		chainLength = 1
+	}
+
+	iss := &issuer{
+		db:       store,
+		config:   config,
+		reissued: map[string]*core.Certificate{},
+		serials:  map[string]struct{}{},
+	}
+
+	keygen := func(label string) (crypto.Signer, error) {
+		if keys.seed != nil {
+			return seededKey(keys.seed, label, config.CAKeyType)
+		}
+		if config.CAKeyType == "" && keys.intermediate != nil {
+			return generateKeyLike(keys.intermediate)
+		}
+		return generateKey(config.CAKeyType)
+	}
+
+	intermediateKey := keys.intermediate
+	if intermediateKey == nil {
+		var err error
+		if intermediateKey, err = keygen("intermediate"); err != nil {
+			return nil, fmt.Errorf("intermediate key: %w", err)
+		}
+	}
+	intermediateSubject := config.CAIntermediateSubject
+	if intermediateSubject.String() == "" {
+		intermediateSubject = pkix.Name{
+			CommonName: "testacme Intermediate CA " + keyID(intermediateKey.Public()),
+		}
+	}
+
+	for i := 0; i < 1+config.CertificateAlternateChains; i++ {
+		var chain *issuerChain
+		var err error
+
+		if i == 0 && len(keys.certs) > 0 {
+			chain, err = providedChain(keys, intermediateKey)
+		} else {
+			rootKey := keys.root
+			if i > 0 || rootKey == nil {
+				if rootKey, err = keygen(fmt.Sprintf("root-%d", i)); err != nil {
+					return nil, fmt.Errorf("root key: %w", err)
+				}
+			}
+			chain, err = iss.buildChain(rootKey, intermediateKey, intermediateSubject, chainLength, func(n int) (crypto.Signer, error) {
+				return keygen(fmt.Sprintf("intermediate-%d-%d", i, n))
+			})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chain %d: %w", i, err)
+		}
+
+		iss.chains = append(iss.chains, chain)
+	}
+
+	return iss, nil
+}
+
+// providedChain builds the chain from the provided root and intermediate
+// certificates.
+func providedChain(keys *caKeys, intermediateKey crypto.Signer) (*issuerChain, error) {
+	if len(keys.certs) != 2 {
+		return nil, errors.New("both root and intermediate certificates are required")
+	}
+	root, intermediate := keys.certs[0], keys.certs[1]
+
+	if keys.root == nil || !publicKeyEqual(root.PublicKey, keys.root.Public()) {
+		return nil, errors.New("root certificate does not match root key")
+	}
+	if !publicKeyEqual(intermediate.PublicKey, intermediateKey.Public()) {
+		return nil, errors.New("intermediate certificate does not match intermediate key")
+	}
+	if err := intermediate.CheckSignatureFrom(root); err != nil {
+		return nil, fmt.Errorf("intermediate certificate not issued by root: %w", err)
+	}
+
+	return &issuerChain{
+		root:          &issuerCert{key: keys.root, cert: coreCertificate(root)},
+		intermediates: []*issuerCert{{key: intermediateKey, cert: coreCertificate(intermediate)}},
+	}, nil
+}
+
+// buildChain creates a chain from the root to the leaf issuing intermediate
+// with chainLength intermediates.
+func (iss *issuer) buildChain(rootKey, intermediateKey crypto.Signer, intermediateSubject pkix.Name, chainLength int, keygen func(int) (crypto.Signer, error)) (*issuerChain, error) {
+	rootSubject := iss.config.CARootSubject
+	if rootSubject.String() == "" {
+		rootSubject = pkix.Name{
+			CommonName: "testacme Root CA " + keyID(rootKey.Public()),
+		}
+	}
+	root, err := iss.signCA(rootKey, rootSubject, nil)
+	if err != nil {
+		return nil, fmt.Errorf("root: %w", err)
+	}
+
+	chain := &issuerChain{
+		root:          root,
+		intermediates: make([]*issuerCert, chainLength),
+	}
+
+	// The last N-1 intermediates build a path from the root to the leaf
+	// issuer, same as Pebble.
+	parent := root
+	for n := chainLength - 1; n > 0; n-- {
+		key, err := keygen(n)
+		if err != nil {
+			return nil, fmt.Errorf("intermediate %d key: %w", n, err)
+		}
+		subject := intermediateSubject
+		subject.CommonName = fmt.Sprintf("%s #%d", intermediateSubject.CommonName, n)
+		intermediate, err := iss.signCA(key, subject, parent)
+		if err != nil {
+			return nil, fmt.Errorf("intermediate %d: %w", n, err)
+		}
+		chain.intermediates[n] = intermediate
+		parent = intermediate
+	}
+
+	intermediate, err := iss.signCA(intermediateKey, intermediateSubject, parent)
+	if err != nil {
+		return nil, fmt.Errorf("intermediate: %w", err)
+	}
+	chain.intermediates[0] = intermediate
+
+	return chain, nil
+}
+
+// signCA creates a CA certificate for key, signed by the parent (or
+// self-signed when parent is nil).
+func (iss *issuer) signCA(key crypto.Signer, subject pkix.Name, parent *issuerCert) (*issuerCert, error) {
+	template := &x509.Certificate{
+		Subject:      subject,
+		SerialNumber: contentSerial([]byte(subject.String()), []byte(keyID(key.Public()))),
+		NotBefore:    deterministicNotBefore,
+		NotAfter:     deterministicNotAfter,
+
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	parentCert, signer := template, key
+	if parent != nil {
+		parentCert, signer = parent.cert.Cert, parent.key
+		// Only certificates issued by another CA point back at it, roots
+		// are self-signed.
+		iss.issuedURLs(template)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, key.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &issuerCert{key: key, cert: coreCertificate(cert)}, nil
+}
+
+// issuedURLs sets the configured AIA and CRL distribution point URLs on
+// certificates issued by the CA.
+func (iss *issuer) issuedURLs(template *x509.Certificate) {
+	if len(iss.config.CAOCSPServerURLs) > 0 {
+		template.OCSPServer = iss.config.CAOCSPServerURLs
+	}
+	template.IssuingCertificateURL = iss.config.CAIssuingCertificateURLs
+	template.CRLDistributionPoints = iss.config.CACRLDistributionPoints
+}
+
+// Reissue replaces the Pebble issued certificate, by its ID, with one issued
+// from the testacme managed chains and provides the replacement. Certificates
+// are only re-issued once, nil is provided for certificates that aren't known.
+//
+// The replacement is added to the store with its own ID, Pebble's certificate
+// can't be removed from the store and is left in place, unreferenced once its
+// order is updated - Pebble's handlers read certificates without holding the
+// store's lock, so they are never modified.
+func (iss *issuer) Reissue(id string) (*core.Certificate, error) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	if reissued, done := iss.reissued[id]; done {
+		return reissued, nil
+	}
+
+	cert := iss.db.GetCertificateByID(id)
+	if cert == nil {
+		// revoked or not (yet) issued, either way nothing to do.
+		return nil, nil
+	}
+
+	leafIssuer := iss.chains[0].intermediates[0]
+	original := cert.Cert
+
+	template := &x509.Certificate{
+		SerialNumber: iss.leafSerial(original),
+		Subject:      original.Subject,
+		DNSNames:     original.DNSNames,
+		IPAddresses:  original.IPAddresses,
+		NotBefore:    original.NotBefore,
+		NotAfter:     original.NotAfter,
+		OCSPServer:   original.OCSPServer,
+
+		KeyUsage:              original.KeyUsage,
+		ExtKeyUsage:           original.ExtKeyUsage,
+		UnknownExtKeyUsage:    original.UnknownExtKeyUsage,
+		SubjectKeyId:          original.SubjectKeyId,
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		ExtraExtensions:       carriedExtensions(original),
+	}
+	iss.issuedURLs(template)
+	if len(template.CRLDistributionPoints) == 0 {
+		template.CRLDistributionPoints = iss.crlURLs
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, leafIssuer.cert.Cert, original.PublicKey, leafIssuer.key)
+	if err != nil {
+		return nil, fmt.Errorf("reissue %s: %w", id, err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("reissue %s: %w", id, err)
+	}
+
+	issuerChains := make([][]*core.Certificate, len(iss.chains))
+	for i, chain := range iss.chains {
+		for _, intermediate := range chain.intermediates {
+			issuerChains[i] = append(issuerChains[i], intermediate.cert)
+		}
+	}
+
+	// IDs are the hex serial, as Pebble assigns them.
+	reissued := &core.Certificate{
+		ID:           hex.EncodeToString(parsed.SerialNumber.Bytes()),
+		AccountID:    cert.AccountID,
+		Cert:         parsed,
+		DER:          der,
+		IssuerChains: issuerChains,
+	}
+	if _, err := iss.db.AddCertificate(reissued); err != nil {
+		return nil, fmt.Errorf("reissue %s: %w", id, err)
+	}
+
+	iss.reissued[id] = reissued
+	iss.reissued[reissued.ID] = reissued
+
+	return reissued, nil
+}
+
+// carriedExtensions provides the extensions of the certificate that aren't set
+// from the re-issued certificate's template, eg: certificate policies.
+func carriedExtensions(cert *x509.Certificate) []pkix.Extension {
+	var carried []pkix.Extension
+	for _, ext := range cert.Extensions {
+		issued := false
+		for _, oid := range oidIssuedExtensions {
+			if ext.Id.Equal(oid) {
+				issued = true
+				break
+			}
+		}
+		if !issued {
+			carried = append(carried, ext)
+		}
+	}
+	return carried
+}
+
+// leafSerial derives a serial number from the certificate's content so that
+// the same request yields the same serial across runs. Caller must hold the
+// lock.
+func (iss *issuer) leafSerial(cert *x509.Certificate) *big.Int {
+	names := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	sort.Strings(names)
+
+	for n := uint64(0); ; n++ {
+		var counter [8]byte
+		binary.BigEndian.PutUint64(counter[:], n)
+
+		serial := contentSerial(
+			iss.chains[0].intermediates[0].cert.Cert.SubjectKeyId,
+			cert.RawSubjectPublicKeyInfo,
+			[]byte(strings.Join(names, ",")),
+			counter[:])
+
+		key := serial.Text(16)
+		if _, used := iss.serials[key]; !used {
+			iss.serials[key] = struct{}{}
+			return serial
+		}
+	}
+}
+
+// Signer provides the leaf issuing Intermediate CA certificate and key.
+func (iss *issuer) Signer() (*x509.Certificate, crypto.Signer) {
+	intermediate := iss.chains[0].intermediates[0]
+	return intermediate.cert.Cert, intermediate.key
+}
+
+// Root returns the Root CA certificate for the given chain.
+func (iss *issuer) Root(no int) *core.Certificate {
+	if no < 0 || no >= len(iss.chains) {
+		return nil
+	}
+	return iss.chains[no].root.cert
+}
+
+// Intermediate returns the leaf issuing Intermediate CA certificate for the
+// given chain.
+func (iss *issuer) Intermediate(no int) *core.Certificate {
+	if no < 0 || no >= len(iss.chains) {
+		return nil
+	}
+	return iss.chains[no].intermediates[0].cert
+}
+
+// WrapHandler re-issues certificates as orders are finalized, waiting for
+// Pebble to issue them before responding, so their serials are the only ones
+// seen by clients (and the OCSP, ARI and revocation services). Certificates
+// are also re-issued before they're downloaded, in case Pebble was slower.
+func (iss *issuer) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, pebbleFinalizePath):
+			rec := httptest.NewRecorder()
+			next.ServeHTTP(rec, r)
+
+			body := rec.Body.Bytes()
+			if rec.Code == http.StatusOK {
+				order := iss.db.GetOrderByID(strings.TrimPrefix(r.URL.Path, pebbleFinalizePath))
+				if cert := awaitCertificate(order, issueTimeout); cert != nil {
+					reissued, err := iss.Reissue(cert.ID)
+					if err != nil {
+						sendProblem(w, acme.InternalErrorProblem(err.Error()))
+						return
+					}
+
+					order.Lock()
+					order.CertificateObject = reissued
+					order.Unlock()
+					// Pebble may have already responded with its
+					// certificate's URL.
+					body = bytes.Replace(body, []byte(pebbleCertPath+cert.ID+`"`), []byte(pebbleCertPath+reissued.ID+`"`), 1)
+				}
+			}
+
+			writeRecorded(w, rec, body)
+
+		case strings.HasPrefix(r.URL.Path, pebbleCertPath):
+			id := strings.TrimPrefix(r.URL.Path, pebbleCertPath)
+			id = strings.SplitN(id, "/", 2)[0]
+			reissued, err := iss.Reissue(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if reissued != nil && reissued.ID != id {
+				// Pebble serves its own certificate by the replaced ID.
+				r.URL.Path = strings.Replace(r.URL.Path, pebbleCertPath+id, pebbleCertPath+reissued.ID, 1)
+			}
+			next.ServeHTTP(w, r)
+
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// awaitCertificate waits for Pebble to issue the order's certificate, nil is
+// provided when it isn't issued within the timeout.
+func awaitCertificate(order *core.Order, timeout time.Duration) *core.Certificate {
+	if order == nil {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		order.RLock()
+		cert := order.CertificateObject
+		order.RUnlock()
+
+		if cert != nil || time.Now().After(deadline) {
+			return cert
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// WrapManagementHandler serves the testacme managed CA certificates and keys
+// in place of Pebble's.
+func (iss *issuer) WrapManagementHandler(next http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", next)
+	mux.Handle(pebbleRootCertPath, iss.serveCA(pebbleRootCertPath, func(c *issuerChain) *issuerCert { return c.root }, false))
+	mux.Handle(pebbleRootKeyPath, iss.serveCA(pebbleRootKeyPath, func(c *issuerChain) *issuerCert { return c.root }, true))
+	mux.Handle(pebbleIntermediateCertPath, iss.serveCA(pebbleIntermediateCertPath, func(c *issuerChain) *issuerCert { return c.intermediates[0] }, false))
+	mux.Handle(pebbleIntermediateKeyPath, iss.serveCA(pebbleIntermediateKeyPath, func(c *issuerChain) *issuerCert { return c.intermediates[0] }, true))
+	return mux
+}
+
+// serveCA mimics Pebble's management handlers for CA certificates and keys.
+func (iss *issuer) serveCA(prefix string, pick func(*issuerChain) *issuerCert, key bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		no, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, prefix))
+		if err != nil || no < 0 || no >= len(iss.chains) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		for i := range iss.chains {
+			if i == no {
+				continue
+			}
+			w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="alternate"`, relativeEndpoint(r, prefix+strconv.Itoa(i))))
+		}
+
+		ca := pick(iss.chains[no])
+		if !key {
+			w.Header().Set("Content-Type", "application/pem-certificate-chain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			w.Write(ca.cert.PEM())
+			return
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(ca.key)
+		if err != nil {
+			// eg: keys held elsewhere, like a HSM.
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		pem.Encode(w, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	})
+}
+
+// coreCertificate wraps the certificate in Pebble's type.
+func coreCertificate(cert *x509.Certificate) *core.Certificate {
+	return &core.Certificate{
+		ID:   hex.EncodeToString(cert.SerialNumber.Bytes()),
+		Cert: cert,
+		DER:  cert.Raw,
+	}
+}
+
+// contentSerial derives a positive, 63 bit, serial number from the given
+// content.
+func contentSerial(content ...[]byte) *big.Int {
+	h := sha256.New()
+	for _, c := range content {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(c)))
+		h.Write(length[:])
+		h.Write(c)
+	}
+	sum := h.Sum(nil)
+
+	serial := binary.BigEndian.Uint64(sum[:8]) & (1<<63 - 1)
+	if serial == 0 {
+		serial = 1
+	}
+	return new(big.Int).SetUint64(serial)
+}
+
+// seededKey derives a key of the given type for the label from the seed.
+// ECDSA P-256 keys are derived when no type is given.
+func seededKey(seed []byte, label string, keyType CAKeyType) (crypto.Signer, error) {
+	mac := hmac.New(sha256.New, seed)
+	mac.Write([]byte(label))
+	derived := mac.Sum(nil)
+
+	switch keyType {
+	case CAKeyEd25519:
+		return ed25519.NewKeyFromSeed(derived), nil
+	case "", CAKeyP256, CAKeyP384:
+		curve := elliptic.P256()
+		if keyType == CAKeyP384 {
+			curve = elliptic.P384()
+		}
+		// d in [1, N-1]
+		n := new(big.Int).Sub(curve.Params().N, big.NewInt(1))
+		d := new(big.Int).SetBytes(derived)
+		d.Mod(d, n).Add(d, big.NewInt(1))
+
+		key := &ecdsa.PrivateKey{D: d}
+		key.PublicKey.Curve = curve
+		key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+		return key, nil
+	default:
+		return nil, fmt.Errorf("cannot derive %s keys from a seed", keyType)
+	}
+}
+
+// generateKey generates a new key of the given type, defaulting to the
+// RSA-2048 keys used by Pebble.
+func generateKey(keyType CAKeyType) (crypto.Signer, error) {
+	switch keyType {
+	case "", CAKeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case CAKeyRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case CAKeyP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case CAKeyP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case CAKeyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+}
+
+// generateKeyLike generates a new key with the same algorithm and size as the
+// given key.
+func generateKeyLike(like crypto.Signer) (crypto.Signer, error) {
+	switch k := like.(type) {
+	case *rsa.PrivateKey:
+		return rsa.GenerateKey(rand.Reader, k.N.BitLen())
+	case *ecdsa.PrivateKey:
+		return ecdsa.GenerateKey(k.Curve, rand.Reader)
+	case ed25519.PrivateKey:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case nil:
+		return nil, errors.New("no key to generate like")
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", like)
+	}
+}
+
+// keyID provides a short, stable, identifier for the public key.
+func keyID(pub crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		panic(fmt.Sprintf("cannot marshal public key: %v", err))
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:3])
+}
+
+// publicKeyEqual compares the public keys by their encoding.
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	ader, aerr := x509.MarshalPKIXPublicKey(a)
+	bder, berr := x509.MarshalPKIXPublicKey(b)
+	return aerr == nil && berr == nil && bytes.Equal(ader, bder)
+}
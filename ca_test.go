@@ -0,0 +1,287 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/letsencrypt/pebble/v2/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithPebbleCASeed(t *testing.T) {
+	seed := []byte(t.Name())
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	obtainTwice := func(t *testing.T, opts ...PebbleOption) (roots []*x509.Certificate, leaves []*x509.Certificate) {
+		for i := 0; i < 2; i++ {
+			pebble := NewPebble(NewTestingContext(t), append([]PebbleOption{WithPebbleCASeed(seed)}, opts...)...)
+
+			roots = append(roots, parsePEMCert(t, fetchManagementPEM(t, pebble, pebbleRootCertPath+"0")))
+			leaves = append(leaves, obtainVerified(t, pebble, leafKey, "seeded.ca.test"))
+		}
+		return roots, leaves
+	}
+
+	t.Run("default", func(t *testing.T) {
+		roots, leaves := obtainTwice(t)
+
+		assert.IsType(t, &ecdsa.PublicKey{}, roots[0].PublicKey, "should derive ECDSA keys")
+		assert.True(t, publicKeyEqual(roots[0].PublicKey, roots[1].PublicKey), "should have identical root keys")
+		assert.Equal(t, leaves[0].SerialNumber, leaves[1].SerialNumber, "should have identical leaf serials")
+		assert.Equal(t, leaves[0].Issuer, leaves[1].Issuer, "should have identical leaf issuers")
+	})
+
+	t.Run("ed25519", func(t *testing.T) {
+		roots, leaves := obtainTwice(t, WithPebbleCAKeyType(CAKeyEd25519))
+
+		assert.Equal(t, roots[0].Raw, roots[1].Raw, "should have identical roots")
+		assert.Equal(t, leaves[0].SerialNumber, leaves[1].SerialNumber, "should have identical leaf serials")
+	})
+}
+
+func TestWithPebbleCAKeys(t *testing.T) {
+	rootKey := readTestdataKey(t, "ca/root.key.pem")
+	intermediateKey := readTestdataKey(t, "ca/intermediate.key.pem")
+	rootCert := readTestdataCert(t, "ca/root.pem")
+	intermediateCert := readTestdataCert(t, "ca/intermediate.pem")
+
+	t.Run("keys", func(t *testing.T) {
+		pebble := NewPebble(NewTestingContext(t), WithPebbleCAKeys(rootKey, intermediateKey))
+
+		root := parsePEMCert(t, fetchManagementPEM(t, pebble, pebbleRootCertPath+"0"))
+		assert.True(t, publicKeyEqual(rootKey.Public(), root.PublicKey), "should use root key")
+
+		leaf := obtainVerified(t, pebble, nil, "keys.ca.test")
+		intermediate := parsePEMCert(t, fetchManagementPEM(t, pebble, pebbleIntermediateCertPath+"0"))
+		assert.NoError(t, leaf.CheckSignatureFrom(intermediate), "should be issued by intermediate")
+	})
+
+	t.Run("certs", func(t *testing.T) {
+		pebble := NewPebble(NewTestingContext(t),
+			WithPebbleCAKeys(rootKey, intermediateKey, rootCert, intermediateCert))
+
+		assert.Equal(t, rootCert.Raw, parsePEMCert(t, fetchManagementPEM(t, pebble, pebbleRootCertPath+"0")).Raw,
+			"should serve testdata root")
+
+		leaf := obtainVerified(t, pebble, nil, "certs.ca.test")
+		assert.Equal(t, intermediateCert.Subject.String(), leaf.Issuer.String())
+		assert.NoError(t, leaf.CheckSignatureFrom(intermediateCert))
+	})
+
+	t.Run("mismatched", func(t *testing.T) {
+		assert.Panics(t, func() {
+			NewPebble(NewTestingContext(t),
+				WithPebbleCAKeys(intermediateKey, rootKey, rootCert, intermediateCert))
+		})
+	})
+}
+
+func TestPebbleServerConfig_CAProfile(t *testing.T) {
+	rootSubject := pkix.Name{CommonName: "Profile Root CA", Organization: []string{"testacme"}}
+	intermediateSubject := pkix.Name{CommonName: "Profile Intermediate CA", Organization: []string{"testacme"}}
+	const (
+		issuerURL = "http://ca.test/intermediate.der"
+		ocspURL   = "http://ca.test/ocsp"
+		crlURL    = "http://ca.test/intermediate.crl"
+	)
+
+	pebble := NewPebble(NewTestingContext(t),
+		WithPebbleCASubjects(rootSubject, intermediateSubject),
+		WithPebbleCAKeyType(CAKeyP256),
+		WithPebbleCAURLs([]string{issuerURL}, []string{ocspURL}, []string{crlURL}))
+
+	for i := 0; i <= pebble.PebbleServerConfig.CertificateAlternateChains; i++ {
+		root := parsePEMCert(t, fetchManagementPEM(t, pebble, fmt.Sprintf("%s%d", pebbleRootCertPath, i)))
+		assert.Equal(t, rootSubject.String(), root.Subject.String(), "chain %d should have root subject", i)
+		assert.Equal(t, x509.ECDSA, root.PublicKeyAlgorithm, "chain %d should have ECDSA root", i)
+
+		intermediate := parsePEMCert(t, fetchManagementPEM(t, pebble, fmt.Sprintf("%s%d", pebbleIntermediateCertPath, i)))
+		assert.Equal(t, intermediateSubject.String(), intermediate.Subject.String(), "chain %d should have intermediate subject", i)
+		assert.Equal(t, []string{crlURL}, intermediate.CRLDistributionPoints)
+	}
+
+	leaf := obtainVerified(t, pebble, nil, "profile.ca.test")
+	assert.Equal(t, intermediateSubject.String(), leaf.Issuer.String())
+	assert.Equal(t, x509.ECDSAWithSHA256, leaf.SignatureAlgorithm)
+	assert.Equal(t, []string{issuerURL}, leaf.IssuingCertificateURL)
+	assert.Equal(t, []string{ocspURL}, leaf.OCSPServer)
+	assert.Equal(t, []string{crlURL}, leaf.CRLDistributionPoints)
+
+	t.Run("invalid key type", func(t *testing.T) {
+		assert.Panics(t, func() {
+			NewPebble(NewTestingContext(t), WithPebbleCAKeyType("dsa"))
+		})
+	})
+}
+
+func TestIssuer_Reissue(t *testing.T) {
+	t.Run("finalize", func(t *testing.T) {
+		pebble := NewPebble(NewTestingContext(t),
+			WithPebbleCASeed([]byte(t.Name())),
+			WithPebbleManualValidation(0))
+		user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+		api := LegoAPIClient(pebble, user)
+
+		order, err := api.Orders.New([]string{"finalize.ca.test"})
+		require.NoError(t, err)
+		validate(t, pebble, api, order.Authorizations[0])
+
+		key, err := certcrypto.GeneratePrivateKey(certcrypto.EC256)
+		require.NoError(t, err)
+		csr, err := certcrypto.GenerateCSR(key, "finalize.ca.test", []string{"finalize.ca.test"}, false)
+		require.NoError(t, err)
+		_, err = api.Orders.UpdateForCSR(order.Finalize, csr)
+		require.NoError(t, err)
+
+		// nothing has been downloaded yet.
+		finalized := pebble.PebbleDB.GetOrderByID(path.Base(order.Location))
+		finalized.RLock()
+		issued := finalized.CertificateObject
+		finalized.RUnlock()
+		require.NotNil(t, issued, "should be issued when finalized")
+
+		intermediate := parsePEMCert(t, fetchManagementPEM(t, pebble, pebbleIntermediateCertPath+"0"))
+		assert.NoError(t, issued.Cert.CheckSignatureFrom(intermediate), "should be issued by the testacme CA")
+		assert.Equal(t, issued, pebble.PebbleDB.GetCertificateBySerial(issued.Cert.SerialNumber))
+	})
+
+	t.Run("extensions", func(t *testing.T) {
+		store := db.NewMemoryStore()
+		iss, err := newIssuer(store, &caKeys{seed: []byte(t.Name())}, PebbleServerConfig{})
+		require.NoError(t, err)
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		policy := pkix.Extension{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 55555, 1}, Value: []byte{0x05, 0x00}}
+		template := &x509.Certificate{
+			SerialNumber:    big.NewInt(1234),
+			Subject:         pkix.Name{CommonName: "extensions.ca.test"},
+			DNSNames:        []string{"extensions.ca.test"},
+			NotBefore:       time.Now(),
+			NotAfter:        time.Now().Add(time.Hour),
+			ExtraExtensions: []pkix.Extension{policy},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		require.NoError(t, err)
+		original, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		cert := coreCertificate(original)
+		_, err = store.AddCertificate(cert)
+		require.NoError(t, err)
+
+		replacement, err := iss.Reissue(cert.ID)
+		require.NoError(t, err)
+		assert.Same(t, original, store.GetCertificateByID(cert.ID).Cert, "should leave the original as-is")
+		require.Same(t, replacement, store.GetCertificateByID(replacement.ID), "should add the replacement")
+		reissued := replacement.Cert
+		assert.NotEqual(t, original.SerialNumber, reissued.SerialNumber, "should be re-issued")
+		assert.Contains(t, reissued.Extensions, policy, "should keep the original's extensions")
+		assert.Equal(t, original.DNSNames, reissued.DNSNames)
+
+		again, err := iss.Reissue(cert.ID)
+		require.NoError(t, err)
+		assert.Same(t, replacement, again, "should only re-issue once")
+	})
+}
+
+// obtainVerified obtains a certificate for the domain and verifies it against
+// each of the testacme roots.
+func obtainVerified(t *testing.T, pebble Pebble, key crypto.PrivateKey, domain string) *x509.Certificate {
+	t.Helper()
+
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+	client := legoChallengeClient(pebble, user, ChallengeTLSALPN01, nil)
+
+	resource, err := client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains:    []string{domain},
+		PrivateKey: key,
+		Bundle:     true,
+	})
+	require.NoError(t, err)
+
+	certs, err := certcrypto.ParsePEMBundle(resource.Certificate)
+	require.NoError(t, err)
+	require.True(t, len(certs) > 1, "should have leaf and intermediates")
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	roots := x509.NewCertPool()
+	for i := 0; i <= pebble.PebbleServerConfig.CertificateAlternateChains; i++ {
+		roots.AddCert(parsePEMCert(t, fetchManagementPEM(t, pebble, fmt.Sprintf("%s%d", pebbleRootCertPath, i))))
+	}
+
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		DNSName:       domain,
+		Intermediates: intermediates,
+		Roots:         roots,
+		CurrentTime:   pebble.Clock().Now(),
+	})
+	require.NoError(t, err, "should verify issued certificate")
+
+	return certs[0]
+}
+
+func fetchManagementPEM(t *testing.T, pebble Pebble, path string) []byte {
+	t.Helper()
+
+	server := pebble.ManagementServer()
+	resp, err := server.Client().Get(server.URL + path)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, 200, resp.StatusCode, "should fetch %s", path)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return body
+}
+
+func parsePEMCert(t *testing.T, data []byte) *x509.Certificate {
+	t.Helper()
+
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block, "should have PEM block")
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+func readTestdataCert(t *testing.T, name string) *x509.Certificate {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return parsePEMCert(t, data)
+}
+
+func readTestdataKey(t *testing.T, name string) crypto.Signer {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block, "should have PEM block")
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	require.NoError(t, err)
+	return key.(crypto.Signer)
+}
@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/miekg/dns"
+)
+
+// ChallengeKind identifies an ACME challenge type.
+type ChallengeKind string
+
+const (
+	// ChallengeHTTP01 is the `http-01` challenge type.
+	ChallengeHTTP01 ChallengeKind = "http-01"
+	// ChallengeTLSALPN01 is the `tls-alpn-01` challenge type.
+	ChallengeTLSALPN01 ChallengeKind = "tls-alpn-01"
+	// ChallengeDNS01 is the `dns-01` challenge type.
+	ChallengeDNS01 ChallengeKind = "dns-01"
+)
+
+// ChallengeKinds lists the challenge types supported by testacme.
+var ChallengeKinds = []ChallengeKind{
+	ChallengeHTTP01,
+	ChallengeTLSALPN01,
+	ChallengeDNS01,
+}
+
+// ForEachChallenge runs the body as a subtest for each of the ChallengeKinds.
+// Each subtest is given a LegoClient, registered with SharedPebble, that has
+// only the one challenge solver enabled. The dns-01 solver publishes its
+// records in the SharedNameserverDB.
+func ForEachChallenge(t *testing.T, body func(t *testing.T, c ChallengeKind, client *lego.Client)) {
+	pebble := SharedPebble()
+
+	for _, kind := range ChallengeKinds {
+		kind := kind
+		t.Run(string(kind), func(t *testing.T) {
+			user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+			client := legoChallengeClient(pebble, user, kind, SharedDNS())
+
+			body(t, kind, client)
+		})
+	}
+}
+
+// legoChallengeClient creates a lego client with only the solver for the
+// given challenge kind enabled.
+func legoChallengeClient(testacme TestACME, user registration.User, kind ChallengeKind, nameserver *DNS) *lego.Client {
+	client := LegoClient(testacme, user)
+
+	// start from a clean slate, then add back the one solver.
+	client.Challenge.Remove(challenge.HTTP01)
+	client.Challenge.Remove(challenge.TLSALPN01)
+	client.Challenge.Remove(challenge.DNS01)
+
+	var err error
+	switch kind {
+	case ChallengeHTTP01:
+		err = client.Challenge.SetHTTP01Provider(SharedHTTP01Responder(testacme.HTTPVerificationPort()))
+	case ChallengeTLSALPN01:
+		err = client.Challenge.SetTLSALPN01Provider(SharedTLSALPN01Responder(testacme.TLSVerificationPort()))
+	case ChallengeDNS01:
+		// lego's recursive nameservers are left alone, they're global to
+		// the process and shared by every client: the propagation check
+		// is the only reason to point them at the nameserver, and records
+		// are published immediately so there's no propagation to wait for.
+		err = client.Challenge.SetDNS01Provider(NewDNS01Provider(nameserver.NameserverDB()),
+			dns01.WrapPreCheck(func(_, _, _ string, _ dns01.PreCheckFunc) (bool, error) {
+				return true, nil
+			}))
+	default:
+		err = fmt.Errorf("unsupported challenge kind %q", kind)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to configure %s solver: %v", kind, err))
+	}
+
+	return client
+}
+
+// DNS01Provider publishes dns-01 challenge records in a NameserverDB.
+type DNS01Provider struct {
+	db *NameserverDB
+}
+
+// DNS01Provider is usable as a lego challenge provider.
+var _ challenge.ProviderTimeout = (*DNS01Provider)(nil)
+
+// NewDNS01Provider creates a dns-01 provider publishing records in the given
+// NameserverDB.
+func NewDNS01Provider(db *NameserverDB) *DNS01Provider {
+	return &DNS01Provider{db: db}
+}
+
+// Present implements challenge.Provider
+func (p *DNS01Provider) Present(domain, token, keyAuth string) error {
+	p.db.StoreExact(*dns01ChallengeMsg(domain, keyAuth))
+	return nil
+}
+
+// CleanUp implements challenge.Provider
+func (p *DNS01Provider) CleanUp(domain, token, keyAuth string) error {
+	p.db.RemoveReplyTo(*dns01ChallengeMsg(domain, keyAuth))
+	return nil
+}
+
+// Timeout implements challenge.ProviderTimeout, records are available as soon
+// as they're presented so there's no reason to wait around.
+func (p *DNS01Provider) Timeout() (timeout, interval time.Duration) {
+	return 10 * time.Second, 10 * time.Millisecond
+}
+
+// dns01ChallengeMsg builds the TXT record reply for the dns-01 challenge.
+//
+// https://www.rfc-editor.org/rfc/rfc8555.html#section-8.4
+func dns01ChallengeMsg(domain, keyAuth string) *dns.Msg {
+	digest := sha256.Sum256([]byte(keyAuth))
+
+	return DNSRRMsg(&dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   dns.CanonicalName("_acme-challenge." + domain),
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		Txt: []string{base64.RawURLEncoding.EncodeToString(digest[:])},
+	})
+}
@@ -0,0 +1,51 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForEachChallenge(t *testing.T) {
+	var ran []ChallengeKind
+
+	ForEachChallenge(t, func(t *testing.T, c ChallengeKind, client *lego.Client) {
+		ran = append(ran, c)
+
+		cert, err := client.Certificate.Obtain(certificate.ObtainRequest{
+			Domains: []string{fmt.Sprintf("%s.foreach.test", c)},
+		})
+		assert.NoError(t, err)
+		assert.NotNil(t, cert)
+	})
+
+	assert.Equal(t, ChallengeKinds, ran, "should run each challenge kind")
+}
+
+func TestDNS01Provider(t *testing.T) {
+	db := new(NameserverDB)
+	provider := NewDNS01Provider(db)
+
+	require.NoError(t, provider.Present("dns01.provider.test", "token", "token.thumbprint"))
+
+	query := new(dns.Msg)
+	query.SetQuestion("_acme-challenge.dns01.provider.test.", dns.TypeTXT)
+	reply := db.LookupReply(query)
+	require.NotNil(t, reply, "should have TXT record reply")
+	if assert.Len(t, reply.Answer, 1) {
+		txt, ok := reply.Answer[0].(*dns.TXT)
+		require.True(t, ok, "should be TXT record")
+		// base64url(sha256("token.thumbprint"))
+		assert.Equal(t, []string{"61rBZ_4knHblO0MNoxFsXZ_eTFUHum0B6IVRbhvUn5I"}, txt.Txt)
+	}
+
+	require.NoError(t, provider.CleanUp("dns01.provider.test", "token", "token.thumbprint"))
+	assert.Nil(t, db.LookupReply(query), "should remove TXT record")
+}
@@ -0,0 +1,255 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/pebble/v2/acme"
+	"github.com/letsencrypt/pebble/v2/core"
+	"github.com/letsencrypt/pebble/v2/db"
+)
+
+// Clock is a controllable clock for testacme services. The clock keeps ticking
+// in step with the system clock, though its time may be pushed forward (or
+// set) to test expiry and renewal without sleeping. The zero value is ready to
+// use and reads the system time.
+//
+// Pebble itself uses the system clock, testacme services using a Clock instead
+// shift the expiry of its objects when the Clock is moved.
+type Clock struct {
+	mu        sync.Mutex
+	offset    time.Duration
+	observers map[int]func(time.Duration)
+	nextID    int
+}
+
+// Now provides the Clock's current time. The system time is provided for a nil
+// Clock.
+func (c *Clock) Now() time.Time {
+	return time.Now().Add(c.Offset())
+}
+
+// Offset is the difference between the Clock and system time.
+func (c *Clock) Offset() time.Duration {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.offset
+}
+
+// Advance pushes the Clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.offset += d
+	observers := make([]func(time.Duration), 0, len(c.observers))
+	for _, observer := range c.observers {
+		observers = append(observers, observer)
+	}
+	c.mu.Unlock()
+
+	for _, observer := range observers {
+		observer(d)
+	}
+}
+
+// Set moves the Clock to t, which may be in the past.
+func (c *Clock) Set(t time.Time) {
+	c.Advance(t.Sub(c.Now()))
+}
+
+// observe calls fn with the change in time whenever the Clock is moved. The
+// returned func stops observing the Clock.
+func (c *Clock) observe(fn func(d time.Duration)) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.observers == nil {
+		c.observers = map[int]func(time.Duration){}
+	}
+	id := c.nextID
+	c.nextID++
+	c.observers[id] = fn
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.observers, id)
+	}
+}
+
+// WithPebbleClock uses the provided Clock for issued certificates' validity
+// and for order and authorization expiry. Pebble still issues the
+// certificates, orders are finalized with the Clock's time as their
+// `notBefore` unless the client requested one. Also see `Pebble.Clock()`.
+func WithPebbleClock(clock *Clock) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		pc.clock = clock
+		return nil
+	}
+}
+
+// WithPebbleCertificateValidityPeriod issues certificates valid for the given
+// period, eg: for short-lived certificates.
+func WithPebbleCertificateValidityPeriod(period time.Duration) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		pc.PebbleServerConfig.CertificateValidityPeriod = period
+		return nil
+	}
+}
+
+// shiftExpiries moves the expiry of tracked orders (and their authorizations)
+// and preauthorizations back by d, so that Pebble's own expiry checks, made
+// with the system clock, agree with a Clock moved forward by d.
+func shiftExpiries(store *db.MemoryStore, tracker *objectTracker, d time.Duration) {
+	shifted := map[string]struct{}{}
+
+	for _, id := range tracker.Orders() {
+		order := store.GetOrderByID(id)
+		if order == nil {
+			continue
+		}
+
+		order.Lock()
+		order.ExpiresDate = order.ExpiresDate.Add(-d)
+		order.Expires = order.ExpiresDate.UTC().Format(time.RFC3339)
+		authzs := order.AuthorizationObjects
+		order.Unlock()
+
+		for _, authz := range authzs {
+			// authorizations may be reused across orders.
+			if _, done := shifted[authz.ID]; done {
+				continue
+			}
+			shifted[authz.ID] = struct{}{}
+
+			authz.Lock()
+			authz.ExpiresDate = authz.ExpiresDate.Add(-d)
+			authz.Expires = authz.ExpiresDate.UTC().Format(time.RFC3339)
+			authz.Unlock()
+		}
+	}
+
+	for _, authz := range tracker.Preauthorizations() {
+		if _, done := shifted[authz.ID]; done {
+			continue
+		}
+		shifted[authz.ID] = struct{}{}
+
+		authz.Lock()
+		authz.ExpiresDate = authz.ExpiresDate.Add(-d)
+		authz.Expires = authz.ExpiresDate.UTC().Format(time.RFC3339)
+		order := authz.Order
+		authz.Unlock()
+
+		// the order only holds the preauthorization.
+		order.Lock()
+		order.ExpiresDate = order.ExpiresDate.Add(-d)
+		order.Expires = order.ExpiresDate.UTC().Format(time.RFC3339)
+		order.Unlock()
+	}
+}
+
+// clockHandler presents the `expires` times of ACME objects in the Clock's
+// time, rather than the system time used by Pebble. Orders are finalized with
+// the Clock's time as their `notBefore`, when not requested otherwise, so that
+// Pebble issues certificates valid from the Clock's time.
+func clockHandler(clock *Clock, store *db.MemoryStore) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			offset := clock.Offset()
+			if offset == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var finalizing *core.Order
+			if r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, pebbleFinalizePath) {
+				var err error
+				if finalizing, err = clockNotBefore(r, store, clock.Now()); err != nil {
+					sendProblem(w, acme.MalformedProblem("unable to read request body"))
+					return
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			next.ServeHTTP(rec, r)
+
+			if finalizing != nil && rec.Code != http.StatusOK {
+				// Pebble didn't begin issuing, leave the order as it was
+				// for the client to retry.
+				finalizing.Lock()
+				finalizing.NotBefore = ""
+				finalizing.Unlock()
+			}
+
+			body := rec.Body.Bytes()
+			if strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+				body = offsetExpires(body, offset)
+			}
+
+			writeRecorded(w, rec, body)
+		})
+	}
+}
+
+// clockNotBefore sets the `notBefore` of the order being finalized by the
+// request, when it's owned by the signing account and doesn't have one, and
+// provides the order that was changed, if any.
+func clockNotBefore(r *http.Request, store *db.MemoryStore, now time.Time) (*core.Order, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	account, _ := verifiedJWS(store, body)
+	order := store.GetOrderByID(strings.TrimPrefix(r.URL.Path, pebbleFinalizePath))
+	if account == nil || order == nil {
+		return nil, nil
+	}
+
+	order.Lock()
+	defer order.Unlock()
+	if order.AccountID != account.ID || order.NotBefore != "" {
+		return nil, nil
+	}
+	order.NotBefore = now.UTC().Format(time.RFC3339)
+	return order, nil
+}
+
+// offsetExpires moves the top level `expires` time in the JSON object by the
+// offset. The body is returned as-is when there's nothing to change.
+func offsetExpires(body []byte, offset time.Duration) []byte {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(body, &object); err != nil {
+		return body
+	}
+	raw, ok := object["expires"]
+	if !ok {
+		return body
+	}
+	var expires time.Time
+	if err := json.Unmarshal(raw, &expires); err != nil {
+		return body
+	}
+
+	object["expires"], _ = json.Marshal(expires.Add(offset).UTC().Format(time.RFC3339))
+
+	rewritten, err := marshalIndent(object)
+	if err != nil {
+		return body
+	}
+	return rewritten
+}
@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClock(t *testing.T) {
+	var clock Clock
+	assert.WithinDuration(t, time.Now(), clock.Now(), time.Second, "zero value should read system time")
+
+	var observed time.Duration
+	stop := clock.observe(func(d time.Duration) { observed += d })
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, time.Hour, clock.Offset())
+	assert.WithinDuration(t, time.Now().Add(time.Hour), clock.Now(), time.Second)
+
+	target := time.Now().Add(-24 * time.Hour)
+	clock.Set(target)
+	assert.WithinDuration(t, target, clock.Now(), time.Second)
+	assert.InDelta(t, float64(-24*time.Hour), float64(clock.Offset()), float64(time.Second))
+	assert.Equal(t, clock.Offset(), observed, "should observe each move")
+
+	stop()
+	clock.Advance(time.Hour)
+	assert.NotEqual(t, clock.Offset(), observed, "should stop observing")
+
+	var nilClock *Clock
+	assert.WithinDuration(t, time.Now(), nilClock.Now(), time.Second, "nil clock should read system time")
+}
+
+func TestWithPebbleClock(t *testing.T) {
+	const validity = 90 * 24 * time.Hour
+	clock := new(Clock)
+	pebble := NewPebble(NewTestingContext(t),
+		WithPebbleClock(clock),
+		WithPebbleCertificateValidityPeriod(validity))
+	require.Equal(t, clock, pebble.Clock())
+
+	t.Run("certificates", func(t *testing.T) {
+		leaf := obtainVerified(t, pebble, nil, "before.clock.test")
+		assert.WithinDuration(t, clock.Now(), leaf.NotBefore, time.Minute)
+		assert.WithinDuration(t, clock.Now().Add(validity), leaf.NotAfter, time.Minute)
+
+		clock.Advance(60 * 24 * time.Hour)
+
+		renewed := obtainVerified(t, pebble, nil, "after.clock.test")
+		assert.WithinDuration(t, clock.Now(), renewed.NotBefore, time.Minute)
+		assert.WithinDuration(t, leaf.NotBefore.Add(60*24*time.Hour), renewed.NotBefore, time.Minute)
+	})
+
+	t.Run("orders", func(t *testing.T) {
+		user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+		api := LegoAPIClient(pebble, user)
+
+		order, err := api.Orders.New([]string{"expiry.clock.test"})
+		require.NoError(t, err)
+		require.Equal(t, acme.StatusPending, order.Status)
+		expires, err := time.Parse(time.RFC3339, order.Expires)
+		require.NoError(t, err)
+		assert.WithinDuration(t, clock.Now(), expires, 25*time.Hour, "should expire relative to the clock")
+		assert.True(t, expires.After(clock.Now()), "should expire in the future")
+
+		clock.Advance(48 * time.Hour)
+
+		order, err = api.Orders.Get(order.Location)
+		require.NoError(t, err)
+		assert.Equal(t, acme.StatusInvalid, order.Status, "should have expired")
+		assert.Equal(t, expires.UTC().Format(time.RFC3339), order.Expires, "should present same expiry")
+	})
+}
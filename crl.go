@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/pebble/v2/db"
+)
+
+// DefaultCRLNextUpdate is the default period between a CRL's thisUpdate and
+// nextUpdate.
+const DefaultCRLNextUpdate = 24 * time.Hour
+
+// oidExtensionReasonCode is the CRL entry reason code extension.
+var oidExtensionReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// WithPebbleCRL publishes a CRL for each Intermediate CA, from the CRLServer,
+// valid for the given period (DefaultCRLNextUpdate, when 0). Issued
+// certificates include a CRL distribution point for their issuer's CRL, unless
+// CACRLDistributionPoints are set.
+//
+// Pebble's own Intermediate CAs can't sign CRLs (they lack the cRLSign key
+// usage), so certificates are issued by the testacme CA in place of Pebble's,
+// as they are with WithPebbleCAKeys.
+func WithPebbleCRL(nextUpdate time.Duration) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		if nextUpdate == 0 {
+			nextUpdate = DefaultCRLNextUpdate
+		}
+		pc.PebbleServerConfig.CRLNextUpdate = nextUpdate
+		return nil
+	}
+}
+
+// crlService generates, and serves, a CRL for each Intermediate CA. CRLs are
+// regenerated when certificates are revoked or once they've passed their
+// nextUpdate.
+type crlService struct {
+	db         *db.MemoryStore
+	issuer     *issuer
+	tracker    *objectTracker
+	clock      *Clock
+	nextUpdate time.Duration
+
+	mu    sync.Mutex
+	cache map[int]*cachedCRL
+}
+
+// cachedCRL is a generated CRL.
+type cachedCRL struct {
+	der        []byte
+	number     int64
+	revoked    int
+	nextUpdate time.Time
+}
+
+func newCRLService(store *db.MemoryStore, issuer *issuer, tracker *objectTracker, clock *Clock, nextUpdate time.Duration) *crlService {
+	return &crlService{
+		db:         store,
+		issuer:     issuer,
+		tracker:    tracker,
+		clock:      clock,
+		nextUpdate: nextUpdate,
+		cache:      map[int]*cachedCRL{},
+	}
+}
+
+// CRL provides the current CRL for the given chain's Intermediate CA.
+func (cs *crlService) CRL(no int) ([]byte, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	revoked := cs.tracker.Revoked()
+	now := cs.clock.Now()
+
+	cached, ok := cs.cache[no]
+	if ok && cached.revoked == len(revoked) && now.Before(cached.nextUpdate) {
+		return cached.der, nil
+	}
+
+	number := int64(1)
+	if ok {
+		number = cached.number + 1
+	}
+
+	entries := make([]pkix.RevokedCertificate, 0, len(revoked))
+	for _, serial := range revoked {
+		rc := cs.db.GetRevokedCertificateBySerial(serial)
+		if rc == nil {
+			continue
+		}
+
+		entry := pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: rc.RevokedAt.Add(cs.clock.Offset()).UTC(),
+		}
+		// unspecified (0) reasons are omitted.
+		if rc.Reason != nil && *rc.Reason != 0 {
+			value, err := asn1.Marshal(asn1.Enumerated(*rc.Reason))
+			if err != nil {
+				return nil, err
+			}
+			entry.Extensions = []pkix.Extension{{Id: oidExtensionReasonCode, Value: value}}
+		}
+		entries = append(entries, entry)
+	}
+
+	intermediate := cs.issuer.chains[no].intermediates[0]
+	thisUpdate := now.UTC().Truncate(time.Second)
+	template := &x509.RevocationList{
+		Number:              big.NewInt(number),
+		ThisUpdate:          thisUpdate,
+		NextUpdate:          thisUpdate.Add(cs.nextUpdate),
+		RevokedCertificates: entries,
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, intermediate.cert.Cert, intermediate.key)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.cache[no] = &cachedCRL{
+		der:        der,
+		number:     number,
+		revoked:    len(revoked),
+		nextUpdate: template.NextUpdate,
+	}
+
+	return der, nil
+}
+
+// ServeHTTP serves the CRL for the chain number in the path, eg: `/0`.
+func (cs *crlService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	no, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+	if err != nil || no < 0 || no >= len(cs.issuer.chains) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	der, err := cs.CRL(no)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.WriteHeader(http.StatusOK)
+	w.Write(der)
+}
+
+// CRLServer provides the CRL server, when enabled with WithPebbleCRL, which
+// serves each Intermediate CA's CRL by its chain number (eg: `/0`). The server
+// is started before returned, if not already started.
+func (p Pebble) CRLServer() *httptest.Server {
+	if p.crlServer == nil {
+		return nil
+	}
+
+	p.crlServerStart.Do(p.crlServer.Start)
+	return p.crlServer
+}
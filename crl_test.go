@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithPebbleCRL(t *testing.T) {
+	pebble := NewPebble(NewTestingContext(t), WithPebbleCRL(time.Hour))
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+	client := LegoClient(pebble, user)
+
+	obtain := func(t *testing.T, domain string) (*certificate.Resource, *x509.Certificate, *x509.Certificate) {
+		resource, err := client.Certificate.Obtain(certificate.ObtainRequest{
+			Domains: []string{domain},
+			Bundle:  true,
+		})
+		require.NoError(t, err)
+		certs, err := certcrypto.ParsePEMBundle(resource.Certificate)
+		require.NoError(t, err)
+		return resource, certs[0], certs[1]
+	}
+
+	fetch := func(t *testing.T, url string, issuer *x509.Certificate) *x509.RevocationList {
+		resp, err := http.Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		der, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		crl, err := x509.ParseRevocationList(der)
+		require.NoError(t, err)
+		require.NoError(t, crl.CheckSignatureFrom(issuer), "should be signed by issuer")
+		return crl
+	}
+
+	revokedSerials := func(crl *x509.RevocationList) []*big.Int {
+		var serials []*big.Int
+		for _, entry := range crl.RevokedCertificates {
+			serials = append(serials, entry.SerialNumber)
+		}
+		return serials
+	}
+
+	resource, leaf, issuer := obtain(t, "acme.crl.test")
+	crlURL := pebble.CRLServer().URL + "/0"
+	require.Equal(t, []string{crlURL}, leaf.CRLDistributionPoints, "should include CRL distribution point")
+
+	crl := fetch(t, crlURL, issuer)
+	assert.Empty(t, crl.RevokedCertificates)
+	assert.Equal(t, time.Hour, crl.NextUpdate.Sub(crl.ThisUpdate))
+
+	t.Run("acme", func(t *testing.T) {
+		require.NoError(t, client.Certificate.Revoke(resource.Certificate))
+
+		updated := fetch(t, crlURL, issuer)
+		assert.Equal(t, []*big.Int{leaf.SerialNumber}, revokedSerials(updated))
+		assert.Equal(t, 1, updated.Number.Cmp(crl.Number), "should have a newer CRL number")
+	})
+
+	t.Run("management", func(t *testing.T) {
+		_, other, _ := obtain(t, "management.crl.test")
+
+		server := pebble.ManagementServer()
+		revokeURL := fmt.Sprintf("%s%s%s", server.URL, pebbleRevokeBySerialPath, other.SerialNumber.Text(16))
+		resp, err := server.Client().Post(revokeURL, "application/json", strings.NewReader(`{"reason": 4}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		updated := fetch(t, crlURL, issuer)
+		assert.Contains(t, revokedSerials(updated), other.SerialNumber)
+
+		resp, err = server.Client().Post(revokeURL, "application/json", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, string(body), "urn:ietf:params:acme:error:alreadyRevoked", "should not revoke twice")
+	})
+
+	t.Run("chains", func(t *testing.T) {
+		for i := 1; i <= pebble.PebbleServerConfig.CertificateAlternateChains; i++ {
+			intermediate := parsePEMCert(t, fetchManagementPEM(t, pebble, fmt.Sprintf("%s%d", pebbleIntermediateCertPath, i)))
+			fetch(t, fmt.Sprintf("%s/%d", pebble.CRLServer().URL, i), intermediate)
+		}
+	})
+}
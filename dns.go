@@ -24,12 +24,23 @@ const (
 // resolve to the local host. The backing NameserverDB is the "authority" and can
 type DNS struct {
 	server *dns.Server
+	db     *NameserverDB
+
+	// started is closed once the server is serving, and served once it has
+	// stopped (or failed to start).
+	started <-chan struct{}
+	served  <-chan struct{}
 }
 
 // NewDNS creates an ephemeral nameserver to drive testacme verifications.
 // Queries will default to 127.0.0.1 unless otherwise configured in the
 // supporting NameserverDB.
 func NewDNS(ctx context.Context, dnsdb *NameserverDB) (*DNS, error) {
+	return newDNS(ctx, dnsdb, dnsdb)
+}
+
+// newDNS creates the nameserver, serving queries with the handler.
+func newDNS(ctx context.Context, dnsdb *NameserverDB, handler dns.Handler) (*DNS, error) {
 	// TODO: resolve loopback address?
 	dnsdb.defaultA = net.ParseIP("127.0.0.1")
 	lc := net.ListenConfig{}
@@ -38,22 +49,74 @@ func NewDNS(ctx context.Context, dnsdb *NameserverDB) (*DNS, error) {
 		return nil, fmt.Errorf("new listener: %w", err)
 	}
 
+	started, served := make(chan struct{}), make(chan struct{})
 	server := &dns.Server{
-		PacketConn: lpc,
-		Handler:    dnsdb,
+		PacketConn:        lpc,
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
 	}
-	go server.ActivateAndServe()
+	go func() {
+		defer close(served)
+		server.ActivateAndServe()
+	}()
 
 	return &DNS{
-		server: server,
+		server:  server,
+		db:      dnsdb,
+		started: started,
+		served:  served,
 	}, nil
 }
 
+// shutdownWith shuts the nameserver down when the context ends.
+func (d DNS) shutdownWith(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		select {
+		case <-d.started:
+			d.server.Shutdown()
+		case <-d.served:
+			// failed to start, nothing to shut down.
+		}
+	}()
+}
+
 // Addr returns the net.Addr where the nameserver is listening.
 func (d DNS) Addr() net.Addr {
 	return d.server.PacketConn.LocalAddr()
 }
 
+// Resolver provides a resolver querying the nameserver, so names resolve as
+// stored in its NameserverDB.
+func (d DNS) Resolver() *net.Resolver {
+	return nameserverResolver(d.Addr().String())
+}
+
+// DialContext connects to the address, resolving its host through the
+// nameserver. It's suitable for use in `http.Transport` and `net.Dialer`
+// alike.
+func (d DNS) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{Resolver: d.Resolver()}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// nameserverResolver provides a resolver querying the nameserver at addr,
+// rather than the system's configured nameservers.
+func nameserverResolver(addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// NameserverDB returns the NameserverDB answering queries for the nameserver.
+func (d DNS) NameserverDB() *NameserverDB {
+	return d.db
+}
+
 // NameserverDB holds a basic datastore of query questions mapped to query
 // responses. This can be used directly as a DNS handler - and is by DNS above.
 type NameserverDB struct {
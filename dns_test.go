@@ -3,6 +3,8 @@
 package testacme
 
 import (
+	"context"
+	"net"
 	"testing"
 	"time"
 
@@ -54,6 +56,21 @@ func TestDNS(t *testing.T) {
 	}
 }
 
+func TestDNS_ShutdownWith(t *testing.T) {
+	ctx, cancel := context.WithCancel(NewTestingContext(t))
+	db := new(NameserverDB)
+	srv, err := newDNS(ctx, db, db)
+	require.NoError(t, err)
+	srv.shutdownWith(ctx)
+
+	cancel()
+	resolver := dns.Client{Timeout: 100 * time.Millisecond}
+	assert.Eventually(t, func() bool {
+		_, _, err := resolver.Exchange(new(dns.Msg).SetQuestion("shutdown.test.", dns.TypeA), srv.Addr().String())
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond, "should stop answering when the context ends")
+}
+
 func TestSharedDNS(t *testing.T) {
 	srv := SharedDNS()
 	t.Logf("starting dns server: %#v (%[1]q)", srv.Addr())
@@ -154,3 +171,29 @@ func TestSharedDNS_NameserverDB(t *testing.T) {
 		}
 	}
 }
+
+func TestDNS_Resolver(t *testing.T) {
+	ctx := NewTestingContext(t)
+	db := new(NameserverDB)
+	db.StoreExact(*DNSRRMsg(MustRR("app.resolver.test. 300 IN A 127.0.0.2")))
+
+	srv, err := NewDNS(ctx, db)
+	require.NoError(t, err)
+
+	addrs, err := srv.Resolver().LookupHost(ctx, "app.resolver.test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.2"}, addrs)
+
+	addrs, err = srv.Resolver().LookupHost(ctx, "default.resolver.test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1"}, addrs)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	conn, err := srv.DialContext(ctx, "tcp", net.JoinHostPort("default.resolver.test", port))
+	require.NoError(t, err, "should dial resolved address")
+	conn.Close()
+}
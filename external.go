@@ -0,0 +1,383 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jahkeup/testacme/pkg/randomports"
+)
+
+// DefaultExternalACMEBinary is the binary launched by LaunchExternalACME when
+// none is configured, looked up in PATH.
+const DefaultExternalACMEBinary = "pebble"
+
+// externalACMEStartTimeout is the time given to a launched server to start
+// serving its directory.
+const externalACMEStartTimeout = 30 * time.Second
+
+// ExternalACMEConfig describes a running ACME server to attach to.
+type ExternalACMEConfig struct {
+	// DirectoryURL is the URL of the server's ACME directory.
+	DirectoryURL string
+	// CABundle is the PEM encoded certificates trusted when connecting to the
+	// ACME API. The system roots are used when empty.
+	CABundle []byte
+	// HTTPVerificationPort is the port the server connects to for HTTP
+	// challenge verification.
+	HTTPVerificationPort int
+	// TLSVerificationPort is the port the server connects to for TLS
+	// challenge verification.
+	TLSVerificationPort int
+	// ManagementURL is the URL of the server's Pebble compatible management
+	// API, if any.
+	ManagementURL string
+}
+
+// ExternalACME is a testacme server running outside of the test process, such
+// as a Pebble or Boulder build used in nightly jobs. Use AttachExternalACME to
+// use a running server, or LaunchExternalACME to start one.
+type ExternalACME struct {
+	config ExternalACMEConfig
+	client *http.Client
+	server *httptest.Server
+
+	shutdownTestACME func()
+}
+
+// ExternalACME is a testacme server.
+var _ TestACME = (*ExternalACME)(nil)
+
+// ExternalACME provides the configured verification port numbers.
+var _ Porter = (*ExternalACME)(nil)
+
+// AttachExternalACME provides the ExternalACME for the running server
+// described by config. The directory is not fetched until used.
+func AttachExternalACME(config ExternalACMEConfig) (*ExternalACME, error) {
+	if config.DirectoryURL == "" {
+		return nil, errors.New("no directory URL given")
+	}
+	if config.HTTPVerificationPort == 0 || config.TLSVerificationPort == 0 {
+		return nil, errors.New("verification ports must be given")
+	}
+
+	origin, err := urlOrigin(config.DirectoryURL)
+	if err != nil {
+		return nil, fmt.Errorf("directory URL: %w", err)
+	}
+
+	var roots *x509.CertPool
+	if len(config.CABundle) > 0 {
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(config.CABundle) {
+			return nil, errors.New("no certificates in CA bundle")
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+
+	return &ExternalACME{
+		config: config,
+		client: &http.Client{Transport: transport},
+		// only the URL is meaningful, the server isn't run by testacme. The
+		// Config is set so that Close is safe.
+		server:           &httptest.Server{URL: origin, Config: &http.Server{}},
+		shutdownTestACME: func() {},
+	}, nil
+}
+
+// Client provides an HTTP client trusting the configured CA bundle.
+func (e *ExternalACME) Client() *http.Client {
+	return e.client
+}
+
+// Server provides a placeholder for the external server, only its URL is set
+// to the origin of the ACME directory. Closing the placeholder does nothing,
+// and its Certificate and Client are nil: use ExternalACME's Client, which
+// trusts the CA bundle, instead.
+func (e *ExternalACME) Server() *httptest.Server {
+	return e.server
+}
+
+// ACMEDirectoryURL returns the configured directory URL.
+func (e *ExternalACME) ACMEDirectoryURL() string {
+	return e.config.DirectoryURL
+}
+
+// HTTPVerificationPort is the port that the external server connects to for
+// HTTP verification challenges.
+func (e *ExternalACME) HTTPVerificationPort() int {
+	return e.config.HTTPVerificationPort
+}
+
+// TLSVerificationPort is the port that the external server connects to for
+// TLS verification challenges.
+func (e *ExternalACME) TLSVerificationPort() int {
+	return e.config.TLSVerificationPort
+}
+
+// Config provides the configuration of the external server, including the
+// addresses chosen for launched servers.
+func (e *ExternalACME) Config() ExternalACMEConfig {
+	return e.config
+}
+
+// Shutdown stops a launched server, it does nothing for attached servers. This
+// does *not* block on shutdown and instead immediately returns control to
+// callers.
+func (e *ExternalACME) Shutdown() {
+	e.shutdownTestACME()
+}
+
+// ExternalACMELaunchConfig configures the server started by LaunchExternalACME.
+type ExternalACMELaunchConfig struct {
+	// Binary is the name or path of the server binary, DefaultExternalACMEBinary
+	// when empty. Names without a path separator are looked up in PATH.
+	Binary string
+	// Args are additional arguments given to the binary.
+	Args []string
+	// Nameserver is the DNS used by the server for verification, SharedDNS
+	// when nil.
+	Nameserver *DNS
+	// Output receives the server's output, which is discarded when nil.
+	Output io.Writer
+}
+
+// LaunchExternalACME starts a Pebble compatible server binary and provides the
+// ExternalACME attached to it once its directory is served. The binary is run
+// with Pebble's command line, as:
+//
+//	<binary> -config <file> -dnsserver <nameserver> <args...>
+//
+// The configuration file has Pebble's format and sets random loopback ports
+// for the servers and verification, and a TLS certificate generated for the
+// API. Servers that can't be run this way, such as Boulder's set of services,
+// can be started separately and attached with AttachExternalACME.
+//
+// The server is stopped when the context ends, or when shutdown.
+func LaunchExternalACME(ctx context.Context, config ExternalACMELaunchConfig) (*ExternalACME, error) {
+	if ctx == nil {
+		panic("nil context provided")
+	}
+
+	binary := config.Binary
+	if binary == "" {
+		binary = DefaultExternalACMEBinary
+	}
+	binary, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, err
+	}
+
+	nameserver := config.Nameserver
+	if nameserver == nil {
+		nameserver = SharedDNS()
+	}
+
+	dir, err := ioutil.TempDir("", "testacme-external-")
+	if err != nil {
+		return nil, err
+	}
+	var started bool
+	defer func() {
+		if !started {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	caBundle, err := writeExternalACMEKeyPair(dir)
+	if err != nil {
+		return nil, fmt.Errorf("generate API certificate: %w", err)
+	}
+
+	ports, err := randomports.RandomPorts(4)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get random ports: %w", err)
+	}
+	listen := net.JoinHostPort("127.0.0.1", ports[0].String())
+	managementListen := net.JoinHostPort("127.0.0.1", ports[1].String())
+
+	configFile := filepath.Join(dir, "pebble-config.json")
+	if err := writeExternalACMEConfig(configFile, externalPebbleConfig{
+		ListenAddress:           listen,
+		ManagementListenAddress: managementListen,
+		Certificate:             filepath.Join(dir, "cert.pem"),
+		PrivateKey:              filepath.Join(dir, "key.pem"),
+		HTTPPort:                ports[2].Int(),
+		TLSPort:                 ports[3].Int(),
+	}); err != nil {
+		return nil, err
+	}
+
+	external, err := AttachExternalACME(ExternalACMEConfig{
+		DirectoryURL:         "https://" + listen + "/dir",
+		CABundle:             caBundle,
+		HTTPVerificationPort: ports[2].Int(),
+		TLSVerificationPort:  ports[3].Int(),
+		ManagementURL:        "https://" + managementListen,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	processCtx, cancel := context.WithCancel(ctx)
+	args := append([]string{"-config", configFile, "-dnsserver", nameserver.Addr().String()}, config.Args...)
+	cmd := exec.CommandContext(processCtx, binary, args...)
+	cmd.Stdout = config.Output
+	cmd.Stderr = config.Output
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+	started = true
+
+	exited := make(chan struct{})
+	var exitErr error
+	go func() {
+		exitErr = cmd.Wait()
+		os.RemoveAll(dir)
+		close(exited)
+	}()
+
+	var shutdown sync.Once
+	external.shutdownTestACME = func() { shutdown.Do(cancel) }
+
+	if err := waitExternalACME(external, exited, externalACMEStartTimeout); err != nil {
+		cancel()
+		<-exited
+		if exitErr != nil {
+			return nil, fmt.Errorf("%w (%s exited: %v)", err, filepath.Base(binary), exitErr)
+		}
+		return nil, err
+	}
+
+	return external, nil
+}
+
+// waitExternalACME waits for the server to serve its directory.
+func waitExternalACME(external *ExternalACME, exited <-chan struct{}, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		resp, err := external.Client().Get(external.ACMEDirectoryURL())
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			err = fmt.Errorf("fetch directory: %s", resp.Status)
+		}
+
+		select {
+		case <-exited:
+			return errors.New("server exited before serving its directory")
+		case <-deadline.C:
+			return fmt.Errorf("server not ready after %s: %w", timeout, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// externalPebbleConfig is the server configuration read by Pebble's command.
+//
+// https://github.com/letsencrypt/pebble/blob/v2.4.0/cmd/pebble/main.go#L21-L35
+type externalPebbleConfig struct {
+	ListenAddress           string `json:"listenAddress"`
+	ManagementListenAddress string `json:"managementListenAddress"`
+	Certificate             string `json:"certificate"`
+	PrivateKey              string `json:"privateKey"`
+	HTTPPort                int    `json:"httpPort"`
+	TLSPort                 int    `json:"tlsPort"`
+}
+
+func writeExternalACMEConfig(name string, config externalPebbleConfig) error {
+	b, err := json.MarshalIndent(map[string]externalPebbleConfig{"pebble": config}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, b, 0o600)
+}
+
+// writeExternalACMEKeyPair writes a self-signed certificate, and its key, for
+// the loopback API listeners into dir, providing the PEM encoded certificate.
+func writeExternalACMEKeyPair(dir string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "testacme external API"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0o600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0o600); err != nil {
+		return nil, err
+	}
+
+	return certPEM, nil
+}
+
+// urlOrigin provides the scheme and host of the URL.
+func urlOrigin(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("%q is not an absolute URL", rawURL)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"encoding/pem"
+	"net/http"
+	"os/exec"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttachExternalACME(t *testing.T) {
+	pebble := SharedPebble()
+
+	external, err := AttachExternalACME(ExternalACMEConfig{
+		DirectoryURL: pebble.ACMEDirectoryURL(),
+		CABundle: pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: pebble.Server().Certificate().Raw,
+		}),
+		HTTPVerificationPort: pebble.HTTPVerificationPort(),
+		TLSVerificationPort:  pebble.TLSVerificationPort(),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, pebble.Server().URL, external.Server().URL)
+	assert.Nil(t, external.Server().Certificate())
+	assert.NotPanics(t, external.Server().Close, "should be safe to close the placeholder")
+
+	user := ManagedUser(TestNamedEmail(t))
+	require.NoError(t, user.Register(external))
+	resource, err := LegoClient(external, user).Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{"attached.external.test"},
+	})
+	require.NoError(t, err)
+	cert, err := certcrypto.ParsePEMCertificate(resource.Certificate)
+	require.NoError(t, err)
+
+	t.Run("unmanaged", func(t *testing.T) {
+		_, err := external.CertificateStatus(cert.SerialNumber)
+		assert.Error(t, err, "should require the management URL")
+		assert.Error(t, external.RevokeBySerial(cert.SerialNumber, ReasonUnspecified))
+	})
+
+	t.Run("managed", func(t *testing.T) {
+		managed, err := AttachExternalACME(ExternalACMEConfig{
+			DirectoryURL: pebble.ACMEDirectoryURL(),
+			CABundle: append(
+				pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pebble.Server().Certificate().Raw}),
+				pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pebble.ManagementServer().Certificate().Raw})...),
+			HTTPVerificationPort: pebble.HTTPVerificationPort(),
+			TLSVerificationPort:  pebble.TLSVerificationPort(),
+			ManagementURL:        pebble.ManagementServer().URL,
+		})
+		require.NoError(t, err)
+
+		AssertNotRevoked(t, managed, cert.SerialNumber)
+		require.NoError(t, managed.RevokeBySerial(cert.SerialNumber, ReasonSuperseded))
+		AssertRevoked(t, managed, cert.SerialNumber, ReasonSuperseded)
+
+		assert.Error(t, managed.AddExternalAccountKey("kid", []byte("key")),
+			"should not add keys through the management API")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := AttachExternalACME(ExternalACMEConfig{DirectoryURL: pebble.ACMEDirectoryURL()})
+		assert.Error(t, err, "should require verification ports")
+
+		_, err = AttachExternalACME(ExternalACMEConfig{
+			DirectoryURL:         "/dir",
+			HTTPVerificationPort: 5002,
+			TLSVerificationPort:  5001,
+		})
+		assert.Error(t, err, "should require an absolute directory URL")
+	})
+}
+
+func TestLaunchExternalACME(t *testing.T) {
+	if _, err := exec.LookPath(DefaultExternalACMEBinary); err != nil {
+		t.Skipf("no %s binary in PATH", DefaultExternalACMEBinary)
+	}
+
+	external, err := LaunchExternalACME(NewTestingContext(t), ExternalACMELaunchConfig{})
+	require.NoError(t, err)
+
+	resp, err := external.Client().Get(external.ACMEDirectoryURL())
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	user := ManagedUser(TestNamedEmail(t))
+	require.NoError(t, user.Register(external))
+	_, err = LegoClient(external, user).Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{"launched.external.test"},
+	})
+	assert.NoError(t, err)
+
+	_, err = external.Roots()
+	assert.NoError(t, err, "should fetch roots from the management API")
+}
+
+func TestLaunchExternalACME_MissingBinary(t *testing.T) {
+	_, err := LaunchExternalACME(NewTestingContext(t), ExternalACMELaunchConfig{
+		Binary: "testacme-no-such-binary",
+	})
+	assert.ErrorIs(t, err, exec.ErrNotFound)
+}
@@ -0,0 +1,308 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/pebble/v2/wfe"
+)
+
+// ACMEEndpoint names an ACME API endpoint, by its directory key where it has
+// one.
+type ACMEEndpoint string
+
+const (
+	EndpointDirectory     ACMEEndpoint = "directory"
+	EndpointNewNonce      ACMEEndpoint = "newNonce"
+	EndpointNewAccount    ACMEEndpoint = "newAccount"
+	EndpointAccount       ACMEEndpoint = "account"
+	EndpointNewOrder      ACMEEndpoint = "newOrder"
+	EndpointOrder         ACMEEndpoint = "order"
+	EndpointOrders        ACMEEndpoint = "orders"
+	EndpointFinalize      ACMEEndpoint = "finalize"
+	EndpointAuthorization ACMEEndpoint = "authorization"
+	EndpointChallenge     ACMEEndpoint = "challenge"
+	EndpointCertificate   ACMEEndpoint = "certificate"
+	EndpointRevokeCert    ACMEEndpoint = "revokeCert"
+	EndpointKeyChange     ACMEEndpoint = "keyChange"
+	EndpointRenewalInfo   ACMEEndpoint = "renewalInfo"
+	EndpointNewAuthz      ACMEEndpoint = "newAuthz"
+)
+
+// endpointPaths maps the endpoints to their path (or path prefix, for those
+// ending in `/`).
+var endpointPaths = map[ACMEEndpoint]string{
+	EndpointDirectory:     wfe.DirectoryPath,
+	EndpointNewNonce:      pebbleNoncePath,
+	EndpointNewAccount:    pebbleNewAccountPath,
+	EndpointAccount:       pebbleAccountPath,
+	EndpointNewOrder:      pebbleNewOrderPath,
+	EndpointOrder:         pebbleOrderPath,
+	EndpointOrders:        pebbleListOrdersPath,
+	EndpointFinalize:      pebbleFinalizePath,
+	EndpointAuthorization: pebbleAuthzPath,
+	EndpointChallenge:     pebbleChallengePath,
+	EndpointCertificate:   pebbleCertPath,
+	EndpointRevokeCert:    pebbleRevokeCertPath,
+	EndpointKeyChange:     pebbleKeyRolloverPath,
+	EndpointRenewalInfo:   pebbleRenewalInfoPath,
+	EndpointNewAuthz:      pebbleNewAuthzPath,
+}
+
+// requestEndpoint provides the endpoint for the request's path, an empty
+// endpoint is returned for unknown paths.
+func requestEndpoint(r *http.Request) ACMEEndpoint {
+	for endpoint, path := range endpointPaths {
+		if strings.HasSuffix(path, "/") && strings.HasPrefix(r.URL.Path, path) || r.URL.Path == path {
+			return endpoint
+		}
+	}
+	return ""
+}
+
+// Fault is a failure injected into responses from the ACME API, in place of
+// Pebble's own response.
+type Fault struct {
+	// Endpoints are the endpoints the fault applies to, all endpoints when
+	// empty.
+	Endpoints []ACMEEndpoint
+	// Times is the number of times the fault is injected, unlimited when 0.
+	Times int
+	// Probability is the chance (between 0 and 1) of injecting the fault in a
+	// matching request, see FaultProbability. The fault is always injected
+	// when nil.
+	Probability *float64
+
+	// Delay holds the response for the duration. The request continues on to
+	// Pebble after the delay when no Status or Problem is given.
+	Delay time.Duration
+	// Drop closes the connection without a response.
+	Drop bool
+	// Status is the response's status code, defaulting to the Problem's
+	// status, or 400 (Bad Request) when the Problem has none.
+	Status int
+	// RetryAfter is sent in the response's Retry-After header, if set.
+	RetryAfter time.Duration
+	// Problem is the problem document sent in the response, if set.
+	Problem *Problem
+}
+
+// FaultProbability provides the Fault's Probability, eg: 0.5 injects the fault
+// in about half of matching requests.
+func FaultProbability(p float64) *float64 {
+	return &p
+}
+
+// BadNonceFault rejects requests' nonces, clients are expected to retry with
+// the fresh nonce provided.
+func BadNonceFault(endpoints ...ACMEEndpoint) Fault {
+	return Fault{
+		Endpoints: endpoints,
+		Problem: &Problem{
+			Type:   acmeErrorNS + "badNonce",
+			Detail: "injected fault: JWS has an invalid anti-replay nonce",
+			Status: http.StatusBadRequest,
+		},
+	}
+}
+
+// RateLimitedFault rejects requests as exceeding a rate limit, clients are
+// expected to retry after the given period.
+func RateLimitedFault(retryAfter time.Duration, endpoints ...ACMEEndpoint) Fault {
+	return Fault{
+		Endpoints:  endpoints,
+		RetryAfter: retryAfter,
+		Problem: &Problem{
+			Type:   acmeErrorNS + "rateLimited",
+			Detail: "injected fault: rate limit exceeded",
+			Status: http.StatusTooManyRequests,
+		},
+	}
+}
+
+// ServiceUnavailableFault rejects requests as though the server is
+// unavailable, clients are expected to retry after the given period.
+func ServiceUnavailableFault(retryAfter time.Duration, endpoints ...ACMEEndpoint) Fault {
+	return Fault{
+		Endpoints:  endpoints,
+		RetryAfter: retryAfter,
+		Problem: &Problem{
+			Type:   acmeErrorNS + "serverInternal",
+			Detail: "injected fault: service unavailable",
+			Status: http.StatusServiceUnavailable,
+		},
+	}
+}
+
+// matches is true when the fault applies to the endpoint.
+func (f Fault) matches(endpoint ACMEEndpoint) bool {
+	if len(f.Endpoints) == 0 {
+		return true
+	}
+	for _, e := range f.Endpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// faultRule is an added Fault and the number of times it's been injected.
+type faultRule struct {
+	Fault
+	injected int
+}
+
+// Faults injects failures into ACME API responses, see WithPebbleFaults. Faults
+// may be added and reset while the server is running. The zero value is ready
+// to use.
+type Faults struct {
+	mu       sync.Mutex
+	rules    []*faultRule
+	injected map[ACMEEndpoint]int
+	// rand decides probable faults, math/rand's shared source is used when
+	// nil.
+	rand *rand.Rand
+}
+
+// Add injects the faults into matching responses. When several faults match a
+// request, the first added is injected.
+func (f *Faults) Add(faults ...Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, fault := range faults {
+		f.rules = append(f.rules, &faultRule{Fault: fault})
+	}
+}
+
+// Reset removes all faults, Pebble's own responses are sent once again.
+func (f *Faults) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rules = nil
+}
+
+// Seed decides faults with a Probability from a source seeded with the given
+// value, so they're injected into the same requests on each run.
+func (f *Faults) Seed(seed int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rand = rand.New(rand.NewSource(seed))
+}
+
+// Injected provides the number of faults injected into responses from the
+// endpoint.
+func (f *Faults) Injected(endpoint ACMEEndpoint) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.injected[endpoint]
+}
+
+// next selects the fault to inject for the endpoint, if any.
+func (f *Faults) next(endpoint ACMEEndpoint) (Fault, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, rule := range f.rules {
+		if !rule.matches(endpoint) || (rule.Times > 0 && rule.injected >= rule.Times) {
+			continue
+		}
+		if rule.Probability != nil && f.float64() >= *rule.Probability {
+			continue
+		}
+
+		rule.injected++
+		if f.injected == nil {
+			f.injected = map[ACMEEndpoint]int{}
+		}
+		f.injected[endpoint]++
+
+		return rule.Fault, true
+	}
+
+	return Fault{}, false
+}
+
+// float64 provides a random number in [0, 1). Caller must hold the lock.
+func (f *Faults) float64() float64 {
+	if f.rand != nil {
+		return f.rand.Float64()
+	}
+	return rand.Float64()
+}
+
+// WrapHandler injects faults into responses for matching requests.
+func (f *Faults) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fault, ok := f.next(requestEndpoint(r))
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if fault.Drop {
+			if hijacker, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hijacker.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+			// the connection can't be taken over, abort the response
+			// instead.
+			panic(http.ErrAbortHandler)
+		}
+
+		if fault.Status == 0 && fault.Problem == nil {
+			// only delayed.
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		setReplayNonce(w, next)
+		if fault.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(fault.RetryAfter.Seconds())))
+		}
+
+		if fault.Problem == nil {
+			w.WriteHeader(fault.Status)
+			return
+		}
+
+		prob := *fault.Problem
+		if fault.Status != 0 {
+			prob.Status = fault.Status
+		}
+		if prob.Status == 0 {
+			prob.Status = http.StatusBadRequest
+		}
+		sendCompoundProblem(w, &prob)
+	})
+}
+
+// WithPebbleFaults injects the faults' failures into ACME API responses, eg:
+// to test client handling of `badNonce` problems, rate limits, unavailability
+// and slow responses.
+func WithPebbleFaults(faults *Faults) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		pc.faults = faults
+		return nil
+	}
+}
@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithPebbleFaults(t *testing.T) {
+	faults := new(Faults)
+	pebble := NewPebble(NewTestingContext(t), WithPebbleFaults(faults))
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+
+	t.Run("bad nonce", func(t *testing.T) {
+		t.Cleanup(faults.Reset)
+		fault := BadNonceFault(EndpointNewOrder, EndpointFinalize)
+		fault.Times = 2
+		faults.Add(fault)
+
+		_, err := LegoClient(pebble, user).Certificate.Obtain(certificate.ObtainRequest{
+			Domains: []string{"bad-nonce.faults.test"},
+		})
+		require.NoError(t, err, "should retry with fresh nonce")
+		assert.Equal(t, 2, faults.Injected(EndpointNewOrder)+faults.Injected(EndpointFinalize))
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		t.Cleanup(faults.Reset)
+		faults.Add(ServiceUnavailableFault(5*time.Second, EndpointNewOrder))
+
+		resp, err := pebble.Client().Post(pebble.Server().URL+pebbleNewOrderPath, "application/jose+json", strings.NewReader("{}"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "5", resp.Header.Get("Retry-After"))
+		assert.NotEmpty(t, resp.Header.Get("Replay-Nonce"))
+
+		_, err = LegoAPIClient(pebble, user).Orders.New([]string{"unavailable.faults.test"})
+		AssertProblem(t, err, "urn:ietf:params:acme:error:serverInternal")
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		t.Cleanup(faults.Reset)
+		faults.Add(RateLimitedFault(time.Minute, EndpointNewOrder))
+
+		_, err := LegoAPIClient(pebble, user).Orders.New([]string{"rate-limited.faults.test"})
+		AssertProblem(t, err, "urn:ietf:params:acme:error:rateLimited")
+	})
+
+	t.Run("problem", func(t *testing.T) {
+		t.Cleanup(faults.Reset)
+		faults.Add(Fault{
+			Endpoints: []ACMEEndpoint{EndpointNewOrder},
+			Problem: &Problem{
+				Type: "urn:ietf:params:acme:error:rejectedIdentifier",
+				Subproblems: []Subproblem{{
+					Type:       "urn:ietf:params:acme:error:rejectedIdentifier",
+					Identifier: ProblemIdentifier{Type: "dns", Value: "problem.faults.test"},
+				}},
+			},
+		})
+
+		resp, err := pebble.Client().Post(pebble.Server().URL+pebbleNewOrderPath, "application/jose+json", strings.NewReader("{}"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "should default the status")
+
+		var prob Problem
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&prob))
+		assert.Equal(t, http.StatusBadRequest, prob.Status)
+		assert.Len(t, prob.Subproblems, 1, "should keep subproblems")
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		t.Cleanup(faults.Reset)
+		faults.Add(Fault{Endpoints: []ACMEEndpoint{EndpointDirectory}, Delay: 200 * time.Millisecond, Times: 1})
+
+		start := time.Now()
+		resp, err := pebble.Client().Get(pebble.ACMEDirectoryURL())
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "should continue to Pebble")
+		assert.True(t, time.Since(start) >= 200*time.Millisecond, "should delay response")
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		t.Cleanup(faults.Reset)
+		faults.Add(Fault{Endpoints: []ACMEEndpoint{EndpointDirectory}, Drop: true, Times: 1})
+
+		// POST, as idempotent requests are retried by the client.
+		_, err := pebble.Client().Post(pebble.ACMEDirectoryURL(), "application/jose+json", strings.NewReader("{}"))
+		assert.Error(t, err, "should drop connection")
+
+		resp, err := pebble.Client().Get(pebble.ACMEDirectoryURL())
+		require.NoError(t, err, "should only drop once")
+		resp.Body.Close()
+	})
+
+	t.Run("probability", func(t *testing.T) {
+		t.Cleanup(faults.Reset)
+		faults.Seed(1)
+
+		head := func(t *testing.T) int {
+			resp, err := pebble.Client().Head(pebble.Server().URL + pebbleNoncePath)
+			require.NoError(t, err)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		injected := func(p float64, requests int) int {
+			faults.Reset()
+			faults.Add(Fault{
+				Endpoints:   []ACMEEndpoint{EndpointNewNonce},
+				Probability: FaultProbability(p),
+				Status:      http.StatusServiceUnavailable,
+			})
+
+			before := faults.Injected(EndpointNewNonce)
+			unavailable := 0
+			for i := 0; i < requests; i++ {
+				if head(t) == http.StatusServiceUnavailable {
+					unavailable++
+				}
+			}
+			assert.Equal(t, unavailable, faults.Injected(EndpointNewNonce)-before)
+			return unavailable
+		}
+
+		assert.InDelta(t, 100, injected(0.5, 200), 20, "should inject about half of the time")
+		assert.Equal(t, 10, injected(1, 10), "should always inject")
+		assert.Equal(t, 0, injected(0, 10), "should never inject")
+	})
+}
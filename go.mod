@@ -8,6 +8,8 @@ require (
 	github.com/letsencrypt/pebble/v2 v2.4.0
 	github.com/miekg/dns v1.1.61
 	github.com/stretchr/testify v1.9.0
+	golang.org/x/crypto v0.24.0
+	gopkg.in/square/go-jose.v2 v2.6.0
 )
 
 require (
@@ -16,13 +18,11 @@ require (
 	github.com/go-jose/go-jose/v3 v3.0.0 // indirect
 	github.com/letsencrypt/challtestsrv v1.2.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/crypto v0.24.0 // indirect
 	golang.org/x/mod v0.18.0 // indirect
 	golang.org/x/net v0.26.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
 	golang.org/x/sys v0.21.0 // indirect
 	golang.org/x/text v0.16.0 // indirect
 	golang.org/x/tools v0.22.0 // indirect
-	gopkg.in/square/go-jose.v2 v2.6.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
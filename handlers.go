@@ -0,0 +1,376 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/letsencrypt/pebble/v2/acme"
+	"github.com/letsencrypt/pebble/v2/core"
+	"github.com/letsencrypt/pebble/v2/db"
+	"github.com/letsencrypt/pebble/v2/wfe"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// middleware wraps a Pebble handler to extend or adjust its behavior.
+type middleware = func(http.Handler) http.Handler
+
+// wrapHandler wraps the handler with the middleware, the first is outermost.
+func wrapHandler(handler http.Handler, middleware ...middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// writeRecorded writes the recorded response, with the given body, to w.
+func writeRecorded(w http.ResponseWriter, rec *httptest.ResponseRecorder, body []byte) {
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(rec.Code)
+	w.Write(body)
+}
+
+// marshalIndent marshals the value the same way that Pebble does.
+func marshalIndent(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, "", "   ")
+}
+
+// sendProblem writes the problem document as Pebble does.
+func sendProblem(w http.ResponseWriter, prob *acme.ProblemDetails) {
+	doc, err := marshalIndent(prob)
+	if err != nil {
+		doc = []byte(`{"detail": "Problem marshaling error message."}`)
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json; charset=utf-8")
+	w.WriteHeader(prob.HTTPStatus)
+	w.Write(doc)
+}
+
+// sendCompoundProblem writes the problem, with its subproblems that Pebble's
+// problems don't have, as the response.
+func sendCompoundProblem(w http.ResponseWriter, prob *Problem) {
+	doc, err := marshalIndent(prob)
+	if err != nil {
+		doc = []byte(`{"detail": "Problem marshaling error message."}`)
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json; charset=utf-8")
+	w.WriteHeader(prob.Status)
+	w.Write(doc)
+}
+
+// setReplayNonce sets a fresh nonce, from Pebble, on responses that don't
+// reach Pebble. Clients need one to retry with, as they would get from Pebble.
+func setReplayNonce(w http.ResponseWriter, pebble http.Handler) {
+	rec := httptest.NewRecorder()
+	pebble.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, pebbleNoncePath, nil))
+	if nonce := rec.Header().Get("Replay-Nonce"); nonce != "" {
+		w.Header().Set("Replay-Nonce", nonce)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// relativeEndpoint provides the absolute URL to the endpoint, with respect to
+// the request, same as Pebble does.
+func relativeEndpoint(r *http.Request, endpoint string) string {
+	proto, host := "http", r.Host
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if specifiedProto := r.Header.Get("X-Forwarded-Proto"); specifiedProto != "" {
+		proto = specifiedProto
+	}
+	if host == "" {
+		host = "localhost"
+	}
+
+	return (&url.URL{Scheme: proto, Host: host, Path: endpoint}).String()
+}
+
+// directoryHandler adds the endpoints, named by their directory key, to the
+// directory served by Pebble.
+func directoryHandler(endpoints map[string]string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != wfe.DirectoryPath {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rec := httptest.NewRecorder()
+			next.ServeHTTP(rec, r)
+
+			body := rec.Body.Bytes()
+			directory := map[string]interface{}{}
+			if rec.Code == http.StatusOK && json.Unmarshal(body, &directory) == nil {
+				for key, endpoint := range endpoints {
+					directory[key] = relativeEndpoint(r, endpoint)
+				}
+				if b, err := marshalIndent(directory); err == nil {
+					body = b
+				}
+			}
+
+			writeRecorded(w, rec, body)
+		})
+	}
+}
+
+// routeHandler serves requests for paths with the prefix using the handler,
+// all other requests continue on to Pebble.
+func routeHandler(prefix string, handler http.Handler) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// statusRecorder records the response status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+// objectTracker records the ACME objects created, and certificates revoked,
+// through the WFE. Pebble's MemoryStore doesn't provide a way to list them all.
+type objectTracker struct {
+	mu      sync.Mutex
+	orders  []string
+	revoked []*big.Int
+	// preauthorizations are created by testacme, outside of any order.
+	preauthorizations []*core.Authorization
+}
+
+// Orders provides the IDs of created orders, oldest first.
+func (ot *objectTracker) Orders() []string {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+
+	return append([]string(nil), ot.orders...)
+}
+
+// Revoked provides the serial numbers of revoked certificates, oldest first.
+func (ot *objectTracker) Revoked() []*big.Int {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+
+	return append([]*big.Int(nil), ot.revoked...)
+}
+
+// Preauthorizations provides the authorizations created with newAuthz, oldest
+// first.
+func (ot *objectTracker) Preauthorizations() []*core.Authorization {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+
+	return append([]*core.Authorization(nil), ot.preauthorizations...)
+}
+
+// trackPreauthorization records the creation of the authorization with
+// newAuthz.
+func (ot *objectTracker) trackPreauthorization(authz *core.Authorization) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+
+	ot.preauthorizations = append(ot.preauthorizations, authz)
+}
+
+// trackRevoked records the revocation of the certificate with the given serial
+// number.
+func (ot *objectTracker) trackRevoked(serial *big.Int) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+
+	ot.revoked = append(ot.revoked, serial)
+}
+
+// WrapHandler records objects as they're created and certificates as they're
+// revoked.
+func (ot *objectTracker) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case pebbleNewOrderPath:
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+
+			if rec.status == http.StatusCreated {
+				if location := w.Header().Get("Location"); location != "" {
+					ot.mu.Lock()
+					ot.orders = append(ot.orders, path.Base(location))
+					ot.mu.Unlock()
+				}
+			}
+
+		case pebbleRevokeCertPath:
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				sendProblem(w, acme.MalformedProblem("unable to read request body"))
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+
+			// Pebble has verified the request when it succeeds, so the
+			// payload can be trusted.
+			if rec.status == http.StatusOK {
+				if serial := revokedSerial(body); serial != nil {
+					ot.trackRevoked(serial)
+				}
+			}
+
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// revokedSerial provides the serial number of the certificate in the
+// revokeCert JWS, without verifying it.
+func revokedSerial(jws []byte) *big.Int {
+	var signed acme.JSONSigned
+	if err := json.Unmarshal(jws, &signed); err != nil {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		return nil
+	}
+	var req struct {
+		Certificate string `json:"certificate"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.Certificate)
+	if err != nil {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil
+	}
+	return cert.SerialNumber
+}
+
+// verifiedJWS provides the account that signed the (flattened JSON) JWS, by
+// its key ID, and the verified payload. A nil account is provided when the JWS
+// can't be verified. The nonce isn't checked, see verifyNonceAndURL.
+func verifiedJWS(store *db.MemoryStore, body []byte) (*core.Account, []byte) {
+	jws, err := jose.ParseSigned(string(body))
+	if err != nil || len(jws.Signatures) != 1 {
+		return nil, nil
+	}
+	account := store.GetAccountByID(path.Base(jws.Signatures[0].Protected.KeyID))
+	if account == nil {
+		return nil, nil
+	}
+	payload, err := jws.Verify(account.Key)
+	if err != nil {
+		return nil, nil
+	}
+	return account, payload
+}
+
+// pebbleURLMismatchDetail starts the detail of the problem Pebble responds
+// with when the JWS `url` header doesn't match the request, once its nonce has
+// been checked. TestVerifyNonceAndURL pins it to the vendored Pebble.
+//
+// https://github.com/letsencrypt/pebble/blob/v2.4.0/wfe/wfe.go#L911-L915
+const pebbleURLMismatchDetail = "JWS header parameter 'url' incorrect"
+
+// nonceProbePath is the endpoint that JWS are posted to by verifyNonceAndURL,
+// the finalize endpoint of an order that never exists.
+const nonceProbePath = pebbleFinalizePath + "testacme-nonce-probe"
+
+// verifyNonceAndURL checks the (flattened JSON) JWS's anti-replay nonce and
+// `url` header, as Pebble does for the requests it serves. Only Pebble can
+// check its nonces, so the JWS is posted to Pebble at nonceProbePath, which
+// rejects it after consuming a valid nonce because the `url` doesn't match.
+// Any other response is taken as the JWS being rejected.
+//
+// https://github.com/letsencrypt/pebble/blob/v2.4.0/wfe/wfe.go#L876-L916
+func verifyNonceAndURL(r *http.Request, body []byte, pebble http.Handler) *acme.ProblemDetails {
+	jws, err := jose.ParseSigned(string(body))
+	if err != nil || len(jws.Signatures) != 1 {
+		return acme.MalformedProblem("Parse error reading JWS")
+	}
+	header := jws.Signatures[0].Protected
+	headerURL, _ := header.ExtraHeaders[jose.HeaderKey("url")].(string)
+	if headerURL == "" {
+		return acme.MalformedProblem("JWS header parameter 'url' required.")
+	}
+	if header.Nonce == "" {
+		return acme.BadNonceProblem("JWS has no anti-replay nonce")
+	}
+
+	expectedURL := (&url.URL{Scheme: "https", Host: r.Host, Path: r.RequestURI}).String()
+	probeURL := (&url.URL{Scheme: "https", Host: r.Host, Path: nonceProbePath}).String()
+	if headerURL == probeURL {
+		// Pebble would accept the url for the probe.
+		return acme.MalformedProblem(fmt.Sprintf(
+			"%s. Expected %q, got %q", pebbleURLMismatchDetail, expectedURL, headerURL))
+	}
+
+	probe := httptest.NewRequest(http.MethodPost, nonceProbePath, bytes.NewReader(body))
+	probe.Host, probe.TLS = r.Host, r.TLS
+	probe.Header.Set("Content-Type", "application/jose+json")
+	probe.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	rec := httptest.NewRecorder()
+	pebble.ServeHTTP(rec, probe)
+
+	var prob acme.ProblemDetails
+	if err := json.Unmarshal(rec.Body.Bytes(), &prob); err != nil {
+		return acme.InternalErrorProblem("unable to check anti-replay nonce")
+	}
+	if prob.Type == acme.BadNonceProblem("").Type {
+		return &prob
+	}
+	if !strings.HasPrefix(prob.Detail, pebbleURLMismatchDetail) {
+		// rejected before the nonce was checked.
+		return &prob
+	}
+
+	if headerURL != expectedURL {
+		return acme.MalformedProblem(fmt.Sprintf(
+			"%s. Expected %q, got %q", pebbleURLMismatchDetail, expectedURL, headerURL))
+	}
+	return nil
+}
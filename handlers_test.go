@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/letsencrypt/pebble/v2/acme"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyNonceAndURL(t *testing.T) {
+	pebble := NewPebble(NewTestingContext(t))
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+	serverURL, err := url.Parse(pebble.Server().URL)
+	require.NoError(t, err)
+	handler := pebble.PebbleWFE.Handler()
+
+	// verify checks the JWS as if posted to newAuthz. Fresh nonces, used when
+	// none is given, are retried when Pebble rejects them at random.
+	verify := func(t *testing.T, nonce, headerURL string) *acme.ProblemDetails {
+		for i := 0; ; i++ {
+			n := nonce
+			if n == "" {
+				n = newNonce(t, pebble)
+			}
+			body := signedJWS(t, user, []byte("{}"), n, headerURL)
+			r := httptest.NewRequest(http.MethodPost, pebbleNewAuthzPath, strings.NewReader(body))
+			r.Host, r.TLS = serverURL.Host, &tls.ConnectionState{}
+
+			prob := verifyNonceAndURL(r, []byte(body), handler)
+			if i < 5 && nonce == "" && prob != nil && prob.Type == acme.BadNonceProblem("").Type {
+				continue
+			}
+			return prob
+		}
+	}
+
+	t.Run("pebble", func(t *testing.T) {
+		// the detail is matched to tell Pebble checked the nonce.
+		for i := 0; ; i++ {
+			resp, _ := signedPost(t, pebble, user, pebble.Server().URL+nonceProbePath, []byte("{}"),
+				newNonce(t, pebble), pebble.Server().URL+"/testacme")
+			prob, err := ParseProblem(resp)
+			require.NoError(t, err)
+			if i < 5 && prob.Type == acmeErrorNS+"badNonce" {
+				continue
+			}
+			assert.Equal(t, acmeErrorNS+"malformed", prob.Type)
+			assert.True(t, strings.HasPrefix(prob.Detail, pebbleURLMismatchDetail),
+				"should match Pebble's detail: %q", prob.Detail)
+			break
+		}
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		assert.Nil(t, verify(t, "", pebble.Server().URL+pebbleNewAuthzPath))
+	})
+
+	t.Run("nonce", func(t *testing.T) {
+		prob := verify(t, "testacme", pebble.Server().URL+pebbleNewAuthzPath)
+		require.NotNil(t, prob)
+		assert.Equal(t, acme.BadNonceProblem("").Type, prob.Type)
+	})
+
+	t.Run("url", func(t *testing.T) {
+		prob := verify(t, "", pebble.Server().URL+nonceProbePath)
+		require.NotNil(t, prob)
+		assert.Equal(t, acme.MalformedProblem("").Type, prob.Type)
+
+		prob = verify(t, "", pebble.Server().URL+"/testacme")
+		require.NotNil(t, prob)
+		assert.Equal(t, acme.MalformedProblem("").Type, prob.Type)
+		assert.True(t, strings.HasPrefix(prob.Detail, pebbleURLMismatchDetail))
+	})
+}
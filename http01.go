@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/http01"
+)
+
+// http01ReadTimeout bounds the time spent reading any one verification
+// request.
+const http01ReadTimeout = 10 * time.Second
+
+// HTTP01Responder answers http-01 challenges for any number of identifiers on
+// a single listener. Key authorizations are served by token, whatever the
+// requested host, so concurrent tests may share the one verification port and
+// IP address identifiers are answered as DNS names are.
+//
+// Requests for hosts registered with a backend are proxied to the backend
+// instead, see RegisterBackend.
+//
+// The listener is bound when the first key authorization, or backend, is
+// registered and closed once the last one is deregistered - the port is only
+// held while challenges are actually in flight.
+type HTTP01Responder struct {
+	addr string
+
+	mu       sync.Mutex
+	keyAuths map[string]string
+	backends map[string]string
+	listener net.Listener
+	server   *http.Server
+}
+
+// HTTP01Responder is usable as a lego challenge provider.
+var _ challenge.Provider = (*HTTP01Responder)(nil)
+
+// NewHTTP01Responder creates a responder that will listen on the given
+// interface and port. Prefer SharedHTTP01Responder when responding to
+// challenges from a shared testacme instance.
+func NewHTTP01Responder(iface, port string) *HTTP01Responder {
+	return &HTTP01Responder{
+		addr:     net.JoinHostPort(iface, port),
+		keyAuths: map[string]string{},
+		backends: map[string]string{},
+	}
+}
+
+// Addr returns the address the responder listens on (or will listen on, when
+// not yet started).
+func (r *HTTP01Responder) Addr() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.listener != nil {
+		return r.listener.Addr().String()
+	}
+	return r.addr
+}
+
+// Register adds the key authorization to be served for the challenge token.
+// Tokens may only be registered once at a time, an error is returned when the
+// token is already registered.
+func (r *HTTP01Responder) Register(token, keyAuth string) error {
+	if token == "" {
+		return errors.New("empty challenge token")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.keyAuths[token]; exists {
+		return fmt.Errorf("key authorization already registered for token %q", token)
+	}
+	if err := r.listen(); err != nil {
+		return err
+	}
+	r.keyAuths[token] = keyAuth
+
+	return nil
+}
+
+// RegisterBackend proxies verification requests for the given host, by their
+// Host header, to the backend address, where another server answers the
+// challenge. Hosts may only be registered once at a time, an error is returned
+// when the host is already registered by another caller.
+func (r *HTTP01Responder) RegisterBackend(host, backend string) error {
+	if _, _, err := net.SplitHostPort(backend); err != nil {
+		return fmt.Errorf("invalid backend address %q: %w", backend, err)
+	}
+	key := routeKey(host)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.backends[key]; exists {
+		return fmt.Errorf("backend already registered for %q", host)
+	}
+	if err := r.listen(); err != nil {
+		return err
+	}
+	r.backends[key] = backend
+
+	return nil
+}
+
+// listen binds the listener, when not yet bound. Callers must hold r.mu.
+func (r *HTTP01Responder) listen() error {
+	if r.listener != nil {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", r.addr)
+	if err != nil {
+		return fmt.Errorf("listen for http-01 challenges: %w", err)
+	}
+	r.listener = l
+	r.server = &http.Server{
+		Handler:     r,
+		ReadTimeout: http01ReadTimeout,
+	}
+	go r.server.Serve(l)
+
+	return nil
+}
+
+// Deregister removes the key authorization for the challenge token. The
+// listener, and its connections, are closed when nothing remains registered.
+func (r *HTTP01Responder) Deregister(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.keyAuths, token)
+	r.release()
+}
+
+// DeregisterBackend stops proxying verification requests for the given host.
+// The listener is closed when nothing remains registered.
+func (r *HTTP01Responder) DeregisterBackend(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.backends, routeKey(host))
+	r.release()
+}
+
+// release closes the listener, and its connections, once nothing remains
+// registered. Callers must hold r.mu.
+func (r *HTTP01Responder) release() {
+	if len(r.keyAuths) == 0 && len(r.backends) == 0 && r.listener != nil {
+		r.server.Close()
+		r.listener = nil
+		r.server = nil
+	}
+}
+
+// Present implements challenge.Provider
+func (r *HTTP01Responder) Present(domain, token, keyAuth string) error {
+	return r.Register(token, keyAuth)
+}
+
+// CleanUp implements challenge.Provider
+func (r *HTTP01Responder) CleanUp(domain, token, keyAuth string) error {
+	r.Deregister(token)
+	return nil
+}
+
+// ServeHTTP serves the key authorization registered for the requested token,
+// or proxies the request when its host is registered with a backend.
+func (r *HTTP01Responder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	backend, routed := r.backends[routeKey(req.Host)]
+	r.mu.Unlock()
+
+	if routed {
+		// The Host header is left as-is, backends see the request as the
+		// verifier made it.
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: backend})
+		proxy.ServeHTTP(w, req)
+		return
+	}
+
+	token := strings.TrimPrefix(req.URL.Path, http01.ChallengePath(""))
+	if req.Method != http.MethodGet || token == req.URL.Path {
+		http.NotFound(w, req)
+		return
+	}
+
+	r.mu.Lock()
+	keyAuth, ok := r.keyAuths[token]
+	r.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+}
@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jahkeup/testacme/pkg/randomports"
+)
+
+func TestHTTP01Responder(t *testing.T) {
+	port, err := randomports.One()
+	require.NoError(t, err)
+	responder := NewHTTP01Responder("", port.String())
+
+	get := func(host, token string) (int, string) {
+		resp, err := http.Get("http://" + net.JoinHostPort(host, port.String()) + http01.ChallengePath(token))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	require.NoError(t, responder.Register("foo-token", "foo-key-auth"))
+	require.NoError(t, responder.Present("bar.test", "bar-token", "bar-key-auth"))
+	assert.Error(t, responder.Register("foo-token", "other-key-auth"), "should not register the same token twice")
+
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		status, body := get(host, "foo-token")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "foo-key-auth", body, "should serve by token for %q", host)
+
+		status, _ = get(host, "unknown-token")
+		assert.Equal(t, http.StatusNotFound, status)
+	}
+
+	responder.Deregister("foo-token")
+	status, _ := get("127.0.0.1", "foo-token")
+	assert.Equal(t, http.StatusNotFound, status, "deregistered tokens should not be served")
+
+	require.NoError(t, responder.CleanUp("bar.test", "bar-token", "bar-key-auth"))
+	_, err = http.Get("http://" + net.JoinHostPort("127.0.0.1", port.String()) + http01.ChallengePath("bar-token"))
+	assert.Error(t, err, "listener should be closed with no registrations")
+}
@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// VerboseLogsEnv is the environment variable that, when set to a non-empty
+// value, has test loggers log immediately rather than only for failed tests.
+const VerboseLogsEnv = "TESTACME_VERBOSE_LOGS"
+
+// testLog buffers logs written by testacme services during a test, logging
+// them through the test when it fails.
+type testLog struct {
+	t       testing.TB
+	verbose bool
+
+	mu    sync.Mutex
+	lines []string
+	// done is set once the test has finished, logs are discarded after.
+	done bool
+}
+
+func newTestLog(t testing.TB, verbose bool) *testLog {
+	tl := &testLog{t: t, verbose: verbose}
+	t.Cleanup(tl.flush)
+	return tl
+}
+
+// Logger provides a logger writing to the testLog with the component as its
+// prefix.
+func (tl *testLog) Logger(component string) *log.Logger {
+	return log.New(tl, fmt.Sprintf("[%s] ", component), log.Lmicroseconds)
+}
+
+// Write implements io.Writer, each write (as made by log.Logger) is one line.
+func (tl *testLog) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	switch {
+	case tl.done:
+		// services may log after the test has finished.
+	case tl.verbose:
+		tl.t.Log(line)
+	default:
+		tl.lines = append(tl.lines, line)
+	}
+
+	return len(p), nil
+}
+
+// flush logs the buffered lines through the test if it failed.
+func (tl *testLog) flush() {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tl.t.Failed() && len(tl.lines) > 0 {
+		tl.t.Logf("testacme logs:\n%s", strings.Join(tl.lines, "\n"))
+	}
+	tl.lines = nil
+	tl.done = true
+}
+
+// WithPebbleTestLogger writes logs from the Pebble CA, VA and WFE through the
+// test, prefixed by their component. Logs are buffered and only written when
+// the test fails, unless VerboseLogsEnv is set.
+//
+// A nameserver logging its queries is used for verification, unless one is set
+// with WithPebbleDNS. The nameserver answers from the SharedNameserverDB.
+func WithPebbleTestLogger(t testing.TB) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		pc.testLog = newTestLog(t, os.Getenv(VerboseLogsEnv) != "")
+		return nil
+	}
+}
+
+// dnsLogHandler logs the queries answered by the handler.
+type dnsLogHandler struct {
+	handler dns.Handler
+	log     *log.Logger
+}
+
+func (h dnsLogHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	h.handler.ServeDNS(&dnsLogResponseWriter{ResponseWriter: w, query: r, log: h.log}, r)
+}
+
+// dnsLogResponseWriter logs the response to the query as its written.
+type dnsLogResponseWriter struct {
+	dns.ResponseWriter
+	query *dns.Msg
+	log   *log.Logger
+}
+
+func (w *dnsLogResponseWriter) WriteMsg(m *dns.Msg) error {
+	var questions []string
+	for _, q := range w.query.Question {
+		questions = append(questions, fmt.Sprintf("%s %s", dns.TypeToString[q.Qtype], q.Name))
+	}
+	var answers []string
+	for _, rr := range m.Answer {
+		answers = append(answers, rr.String())
+	}
+	w.log.Printf("query %s from %s: %s %q",
+		strings.Join(questions, ", "), w.RemoteAddr(), dns.RcodeToString[m.Rcode], answers)
+
+	return w.ResponseWriter.WriteMsg(m)
+}
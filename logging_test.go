@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingTB reports the given test outcome and collects logs, for checking
+// behavior at the end of tests.
+type recordingTB struct {
+	testing.TB
+	failed   bool
+	cleanups []func()
+	logs     []string
+}
+
+func (r *recordingTB) Failed() bool      { return r.failed }
+func (r *recordingTB) Cleanup(fn func()) { r.cleanups = append(r.cleanups, fn) }
+func (r *recordingTB) Log(args ...interface{}) {
+	r.logs = append(r.logs, fmt.Sprint(args...))
+}
+func (r *recordingTB) Logf(format string, args ...interface{}) {
+	r.logs = append(r.logs, fmt.Sprintf(format, args...))
+}
+
+// finish runs the cleanups, as at the end of a test.
+func (r *recordingTB) finish() {
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		r.cleanups[i]()
+	}
+}
+
+func TestWithPebbleTestLogger(t *testing.T) {
+	t.Run("failed", func(t *testing.T) {
+		tb := &recordingTB{TB: t, failed: true}
+		pebble := NewPebble(NewTestingContext(t), WithPebbleTestLogger(tb))
+		user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+
+		_, err := LegoClient(pebble, user).Certificate.Obtain(certificate.ObtainRequest{
+			Domains: []string{"failed.logger.test"},
+		})
+		require.NoError(t, err)
+		assert.Empty(t, tb.logs, "should buffer logs")
+
+		tb.finish()
+		require.Len(t, tb.logs, 1)
+		for _, component := range []string{"[ca] ", "[va] ", "[wfe] ", "[dns] "} {
+			assert.Contains(t, tb.logs[0], component)
+		}
+		assert.Contains(t, tb.logs[0], "failed.logger.test")
+
+		pebble.PebbleLogger.Println("after the test")
+		assert.Len(t, tb.logs, 1, "should discard logs after test")
+	})
+
+	t.Run("passed", func(t *testing.T) {
+		tb := &recordingTB{TB: t}
+		log := newTestLog(tb, false)
+		log.Logger("wfe").Println("hello")
+
+		tb.finish()
+		assert.Empty(t, tb.logs, "should not log for passing test")
+	})
+
+	t.Run("verbose", func(t *testing.T) {
+		tb := &recordingTB{TB: t}
+		log := newTestLog(tb, true)
+		log.Logger("wfe").Println("hello")
+
+		require.Len(t, tb.logs, 1, "should log immediately")
+		assert.Contains(t, tb.logs[0], "[wfe] ")
+		assert.Contains(t, tb.logs[0], "hello")
+	})
+}
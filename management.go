@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// Pebble and ExternalACME provide their Root CA certificates.
+var (
+	_ RootProvider = (*Pebble)(nil)
+	_ RootProvider = (*ExternalACME)(nil)
+)
+
+// errNoManagementURL is returned managing an ExternalACME that has no
+// management API configured.
+var errNoManagementURL = errors.New("no management URL configured")
+
+// Roots provides the Root CA certificates of every chain, as served by the
+// management API.
+func (p Pebble) Roots() (*x509.CertPool, error) {
+	server := p.ManagementServer()
+	return managementRoots(server.Client(), server.URL)
+}
+
+// Roots provides the Root CA certificates of every chain, as served by the
+// configured (Pebble compatible) management API. Without a management API, the
+// CA bundle's certificates are provided, or the system roots when there's no
+// CA bundle either.
+func (e *ExternalACME) Roots() (*x509.CertPool, error) {
+	if e.config.ManagementURL != "" {
+		return managementRoots(e.client, e.config.ManagementURL)
+	}
+	if len(e.config.CABundle) > 0 {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(e.config.CABundle)
+		return pool, nil
+	}
+	return x509.SystemCertPool()
+}
+
+// managementRoots fetches the Root CA certificates of each chain from the
+// management API, until there are no more chains.
+func managementRoots(client *http.Client, managementURL string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for i := 0; ; i++ {
+		resp, err := client.Get(managementURL + pebbleRootCertPath + strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			if !pool.AppendCertsFromPEM(body) {
+				return nil, fmt.Errorf("no root certificate in chain %d", i)
+			}
+		case i > 0:
+			// past the last chain.
+			return pool, nil
+		default:
+			return nil, fmt.Errorf("fetch root certificate: %s", resp.Status)
+		}
+	}
+}
+
+// AddExternalAccountKey adds the MAC key for binding accounts to the external
+// account keyID. Accounts may be bound whether or not binding is required by
+// the PebbleServerConfig.
+func (p Pebble) AddExternalAccountKey(keyID string, key []byte) error {
+	return p.PebbleDB.AddExternalAccountKeyByID(keyID, base64.RawURLEncoding.EncodeToString(key))
+}
+
+// AddExternalAccountKey can't add keys to external servers: Pebble's
+// management API has no endpoint for them, so they must be configured when
+// the server is started, eg: Pebble's `externalAccountMACKeys`.
+func (e *ExternalACME) AddExternalAccountKey(keyID string, key []byte) error {
+	return fmt.Errorf("cannot add external account key %q: not supported by the management API", keyID)
+}
@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPebble_Roots(t *testing.T) {
+	pebble := SharedPebble()
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+
+	resource, err := LegoClient(pebble, user).Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{"roots.management.test"},
+		Bundle:  true,
+	})
+	require.NoError(t, err)
+	chain, err := certcrypto.ParsePEMBundle(resource.Certificate)
+	require.NoError(t, err)
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	roots, err := pebble.Roots()
+	require.NoError(t, err)
+	_, err = chain[0].Verify(x509.VerifyOptions{
+		DNSName:       "roots.management.test",
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	assert.NoError(t, err)
+}
+
+func TestPebble_AddExternalAccountKey(t *testing.T) {
+	pebble := NewPebble(NewTestingContext(t), func(pc *pebbleConfig) error {
+		pc.PebbleServerConfig.RequireExternalAccountBinding = true
+		return nil
+	})
+
+	hmac := make([]byte, 32)
+	_, err := rand.Read(hmac)
+	require.NoError(t, err)
+	require.NoError(t, pebble.AddExternalAccountKey("testacme-kid", hmac))
+
+	user := ManagedUser(TestNamedEmail(t))
+	assert.Error(t, user.Register(pebble), "should require external account binding")
+
+	config := lego.NewConfig(user)
+	config.CADirURL = pebble.ACMEDirectoryURL()
+	config.HTTPClient = pebble.Client()
+	client, err := lego.NewClient(config)
+	require.NoError(t, err)
+
+	reg, err := client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+		TermsOfServiceAgreed: true,
+		Kid:                  "testacme-kid",
+		HmacEncoded:          base64.RawURLEncoding.EncodeToString(hmac),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "valid", reg.Body.Status)
+}
+
+func TestExtensionInterfaces(t *testing.T) {
+	pebble := SharedPebble()
+	// only the TestACME methods are promoted, hiding Pebble's extensions.
+	minimal := struct{ TestACME }{pebble}
+
+	roots, err := trustedRoots(minimal)
+	assert.NoError(t, err)
+	assert.Nil(t, roots, "should use the system roots")
+	transport, err := Transport(minimal, nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, transport)
+
+	_, err = managedCertificateStatus(minimal, big.NewInt(1))
+	assert.Error(t, err, "should not provide certificate status")
+
+	external, err := AttachExternalACME(ExternalACMEConfig{
+		DirectoryURL:         pebble.ACMEDirectoryURL(),
+		HTTPVerificationPort: pebble.HTTPVerificationPort(),
+		TLSVerificationPort:  pebble.TLSVerificationPort(),
+	})
+	require.NoError(t, err)
+	roots, err = external.Roots()
+	assert.NoError(t, err, "should use the system roots without a management URL")
+	assert.NotNil(t, roots)
+
+	bundled, err := AttachExternalACME(ExternalACMEConfig{
+		DirectoryURL: pebble.ACMEDirectoryURL(),
+		CABundle: pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: pebble.Server().Certificate().Raw,
+		}),
+		HTTPVerificationPort: pebble.HTTPVerificationPort(),
+		TLSVerificationPort:  pebble.TLSVerificationPort(),
+	})
+	require.NoError(t, err)
+	roots, err = bundled.Roots()
+	require.NoError(t, err)
+	_, err = pebble.Server().Certificate().Verify(x509.VerifyOptions{Roots: roots})
+	assert.NoError(t, err, "should use the CA bundle without a management URL")
+	_, err = Transport(bundled, nil)
+	assert.NoError(t, err)
+
+	unreachable, err := AttachExternalACME(ExternalACMEConfig{
+		DirectoryURL:         pebble.ACMEDirectoryURL(),
+		ManagementURL:        "https://127.0.0.1:1",
+		HTTPVerificationPort: pebble.HTTPVerificationPort(),
+		TLSVerificationPort:  pebble.TLSVerificationPort(),
+	})
+	require.NoError(t, err)
+	_, err = Transport(unreachable, nil)
+	assert.Error(t, err, "should return errors getting roots")
+}
@@ -0,0 +1,306 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/pebble/v2/acme"
+	"github.com/letsencrypt/pebble/v2/core"
+	"github.com/letsencrypt/pebble/v2/db"
+)
+
+// ValidationResult is the outcome of a manually resolved challenge.
+type ValidationResult string
+
+const (
+	// ValidationValid resolves the challenge, and its authorization, as valid.
+	ValidationValid ValidationResult = acme.StatusValid
+	// ValidationInvalid resolves the challenge, its authorization and order as
+	// invalid.
+	ValidationInvalid ValidationResult = acme.StatusInvalid
+)
+
+// manualValidator answers challenge requests in place of Pebble's VA, leaving
+// the challenges in processing until resolved by the test.
+type manualValidator struct {
+	db    *db.MemoryStore
+	hold  time.Duration
+	clock *Clock
+	// validated is called once challenges are resolved as valid, eg: for
+	// authorizationService.adjustValidity to give their authorizations the
+	// validity period.
+	validated func()
+
+	mu         sync.Mutex
+	challenges map[string]*manualChallenge
+}
+
+// manualChallenge is a challenge's manual validation, by token. The challenge
+// is set once requested, the result once resolved.
+type manualChallenge struct {
+	chal      *core.Challenge
+	requested time.Time
+	result    ValidationResult
+	problem   *Problem
+	applied   bool
+}
+
+func newManualValidator(store *db.MemoryStore, hold time.Duration, clock *Clock) *manualValidator {
+	return &manualValidator{
+		db:         store,
+		hold:       hold,
+		clock:      clock,
+		validated:  func() {},
+		challenges: map[string]*manualChallenge{},
+	}
+}
+
+// WrapHandler answers requests to validate challenges, setting them to
+// processing, rather than having Pebble's VA validate them. Other requests,
+// including POST-as-GET requests and those Pebble would reject, are served by
+// Pebble.
+func (mv *manualValidator) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, pebbleChallengePath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			sendProblem(w, acme.MalformedProblem("unable to read request body"))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		chal := mv.challengeRequest(body, path.Base(r.URL.Path))
+		if chal == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		setReplayNonce(w, next)
+		if prob := verifyNonceAndURL(r, body, next); prob != nil {
+			sendProblem(w, prob)
+			return
+		}
+
+		mv.request(chal)
+
+		chal.RLock()
+		doc, err := marshalIndent(chal.Challenge)
+		authzURL := chal.Authz.URL
+		chal.RUnlock()
+		if err != nil {
+			sendProblem(w, acme.InternalErrorProblem("Error marshaling challenge"))
+			return
+		}
+
+		w.Header().Add("Link", fmt.Sprintf("<%s>;rel=%q", authzURL, "up"))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(doc)
+	})
+}
+
+// challengeRequest provides the challenge that the (flattened JSON) JWS
+// requests validation of, nil is provided when Pebble would reject the
+// request.
+func (mv *manualValidator) challengeRequest(body []byte, chalID string) *core.Challenge {
+	account, payload := verifiedJWS(mv.db, body)
+	if account == nil || string(payload) != "{}" {
+		return nil
+	}
+
+	chal := mv.db.GetChallengeByID(chalID)
+	if chal == nil {
+		return nil
+	}
+	// objects are locked in turn, Pebble locks orders before authorizations,
+	// and authorizations before challenges.
+	chal.RLock()
+	status, authz := chal.Status, chal.Authz
+	chal.RUnlock()
+	if status != acme.StatusPending || authz == nil {
+		return nil
+	}
+
+	authz.RLock()
+	status, order := authz.Status, authz.Order
+	authz.RUnlock()
+	if status != acme.StatusPending || order == nil {
+		return nil
+	}
+
+	order.RLock()
+	accountID, expires := order.AccountID, order.ExpiresDate
+	order.RUnlock()
+	if accountID != account.ID || time.Now().After(expires) {
+		return nil
+	}
+
+	return chal
+}
+
+// request sets the challenge to processing, applying the result when it's
+// already been resolved.
+func (mv *manualValidator) request(chal *core.Challenge) {
+	chal.Lock()
+	chal.Status = acme.StatusProcessing
+	token := chal.Token
+	chal.Unlock()
+
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+
+	mc, ok := mv.challenges[token]
+	if !ok {
+		mc = &manualChallenge{}
+		mv.challenges[token] = mc
+	}
+	mc.chal = chal
+	mc.requested = time.Now()
+	if mc.result != "" {
+		mv.schedule(mc)
+	}
+}
+
+// resolve sets the result of the challenge with the token, applying it when
+// the challenge has been requested.
+func (mv *manualValidator) resolve(token string, result ValidationResult, problem *Problem) error {
+	switch {
+	case result == ValidationValid && problem != nil:
+		return errors.New("problem given for valid result")
+	case result == ValidationInvalid && problem == nil:
+		problem = &Problem{
+			Type:   acmeErrorNS + "incorrectResponse",
+			Detail: "challenge resolved as invalid by test",
+			Status: http.StatusForbidden,
+		}
+	case result != ValidationValid && result != ValidationInvalid:
+		return fmt.Errorf("unknown validation result %q", result)
+	}
+
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+
+	mc, ok := mv.challenges[token]
+	if !ok {
+		mc = &manualChallenge{}
+		mv.challenges[token] = mc
+	}
+	if mc.result != "" {
+		return fmt.Errorf("challenge %q already resolved as %s", token, mc.result)
+	}
+	mc.result = result
+	mc.problem = problem
+	if mc.chal != nil {
+		mv.schedule(mc)
+	}
+
+	return nil
+}
+
+// schedule applies the challenge's result once held for the hold period.
+// Callers must hold mv.mu.
+func (mv *manualValidator) schedule(mc *manualChallenge) {
+	delay := mv.hold - time.Since(mc.requested)
+	if delay <= 0 {
+		mv.apply(mc)
+		return
+	}
+	time.AfterFunc(delay, func() {
+		mv.mu.Lock()
+		defer mv.mu.Unlock()
+		mv.apply(mc)
+	})
+}
+
+// apply updates the challenge, its authorization and order, as Pebble's VA
+// does. Callers must hold mv.mu.
+func (mv *manualValidator) apply(mc *manualChallenge) {
+	if mc.applied {
+		return
+	}
+	mc.applied = true
+
+	chal := mc.chal
+	chal.RLock()
+	authz := chal.Authz
+	chal.RUnlock()
+
+	// expiries are kept in Pebble's system time, and presented in the
+	// Clock's time by clockHandler, see shiftExpiries.
+	now := mv.clock.Now().UTC()
+	if mc.result == ValidationValid {
+		authz.Lock()
+		authz.ExpiresDate = time.Now().UTC().Add(pebbleValidAuthzExpiry)
+		authz.Expires = authz.ExpiresDate.Format(time.RFC3339)
+		authz.Status = acme.StatusValid
+		chal.Lock()
+		chal.ValidatedDate = now
+		chal.Validated = now.Format(time.RFC3339)
+		chal.Status = acme.StatusValid
+		chal.Unlock()
+		authz.Unlock()
+
+		// as set by Pebble's VA, until given the configured validity.
+		mv.validated()
+		return
+	}
+
+	prob := &acme.ProblemDetails{
+		Type:       mc.problem.Type,
+		Detail:     mc.problem.Detail,
+		HTTPStatus: mc.problem.Status,
+	}
+	authz.Lock()
+	authz.Status = acme.StatusInvalid
+	order := authz.Order
+	chal.Lock()
+	chal.ValidatedDate = now
+	chal.Validated = now.Format(time.RFC3339)
+	chal.Error = prob
+	chal.Status = acme.StatusInvalid
+	chal.Unlock()
+	authz.Unlock()
+
+	order.Lock()
+	order.Error = prob
+	order.Unlock()
+}
+
+// WithPebbleManualValidation answers challenges without validating them, see
+// `Pebble.ResolveChallenge()`. Requested challenges are held in processing
+// until resolved, and for at least the hold period. Pebble's VA doesn't
+// connect to the verification ports, or query DNS, at all.
+func WithPebbleManualValidation(hold time.Duration) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		if hold < 0 {
+			return fmt.Errorf("negative manual validation hold: %s", hold)
+		}
+		pc.manualValidation = &hold
+		return nil
+	}
+}
+
+// ResolveChallenge decides the result of validating the challenge with the
+// token, when set up WithPebbleManualValidation. The challenge is resolved
+// once requested, and held for the hold period, challenges may be resolved
+// before they're requested. Invalid challenges have the problem as their error,
+// an `incorrectResponse` problem is used when nil.
+func (p Pebble) ResolveChallenge(token string, result ValidationResult, problem *Problem) error {
+	if p.manualValidator == nil {
+		return errors.New("manual validation is not enabled")
+	}
+	return p.manualValidator.resolve(token, result, problem)
+}
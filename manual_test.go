@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"net/http"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPebble_ResolveChallenge(t *testing.T) {
+	const hold = 500 * time.Millisecond
+	pebble := NewPebble(NewTestingContext(t), WithPebbleManualValidation(hold))
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+	accountURL := user.GetRegistration().URI
+
+	// processingChallenge waits for the order's challenge to be requested.
+	processingChallenge := func(t *testing.T, name string) Challenge {
+		var chal Challenge
+		require.Eventually(t, func() bool {
+			for _, order := range pebble.Orders(accountURL) {
+				if order.Identifiers[0].Value != name {
+					continue
+				}
+				for _, c := range order.Authorizations[0].Challenges {
+					if c.Status == "processing" {
+						chal = c
+						return true
+					}
+				}
+			}
+			return false
+		}, 10*time.Second, 10*time.Millisecond)
+		return chal
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		client := LegoClient(pebble, user)
+		client.Challenge.Remove(challenge.HTTP01)
+		require.NoError(t, client.Challenge.SetTLSALPN01Provider(ignoredProvider{}))
+
+		obtained := make(chan error, 1)
+		go func() {
+			_, err := client.Certificate.Obtain(certificate.ObtainRequest{
+				Domains: []string{"valid.manual.test"},
+			})
+			obtained <- err
+		}()
+
+		chal := processingChallenge(t, "valid.manual.test")
+		for _, order := range pebble.Orders(accountURL) {
+			assert.Equal(t, "pending", order.Status, "should be pending until resolved")
+		}
+
+		require.NoError(t, pebble.ResolveChallenge(chal.Token, ValidationValid, nil))
+		select {
+		case err := <-obtained:
+			assert.NoError(t, err)
+		case <-time.After(30 * time.Second):
+			t.Fatal("certificate not obtained")
+		}
+
+		assert.Error(t, pebble.ResolveChallenge(chal.Token, ValidationInvalid, nil), "should only resolve once")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		api := LegoAPIClient(pebble, user)
+		order, err := api.Orders.New([]string{"invalid.manual.test"})
+		require.NoError(t, err)
+		authz, err := api.Authorizations.Get(order.Authorizations[0])
+		require.NoError(t, err)
+		chal := authz.Challenges[0]
+
+		// resolved ahead of the request, and held until after.
+		require.NoError(t, pebble.ResolveChallenge(chal.Token, ValidationInvalid, &Problem{
+			Type:   acmeErrorNS + "dns",
+			Detail: "no such host",
+			Status: 400,
+		}))
+
+		requested := time.Now()
+		_, err = api.Challenges.New(chal.URL)
+		require.NoError(t, err)
+		held := processingChallenge(t, "invalid.manual.test")
+		assert.Equal(t, chal.Token, held.Token)
+
+		require.Eventually(t, func() bool {
+			return pebble.Orders(accountURL)[1].Status == "invalid"
+		}, 10*time.Second, 10*time.Millisecond)
+		assert.GreaterOrEqual(t, time.Since(requested), hold, "should be held in processing")
+
+		snapshot := pebble.Orders(accountURL)[1]
+		require.NotNil(t, snapshot.Error)
+		assert.Equal(t, acmeErrorNS+"dns", snapshot.Error.Type)
+		assert.Equal(t, "invalid", snapshot.Authorizations[0].Status)
+		for _, c := range snapshot.Authorizations[0].Challenges {
+			if c.Token == chal.Token {
+				assert.Equal(t, "invalid", c.Status)
+				assert.Equal(t, "no such host", c.Error.Detail)
+				assert.False(t, c.Validated.IsZero())
+			}
+		}
+	})
+
+	t.Run("replayed", func(t *testing.T) {
+		api := LegoAPIClient(pebble, user)
+		order, err := api.Orders.New([]string{"replayed.manual.test"})
+		require.NoError(t, err)
+		authz, err := api.Authorizations.Get(order.Authorizations[0])
+		require.NoError(t, err)
+		chal := authz.Challenges[0]
+
+		resp, _ := signedPost(t, pebble, user, chal.URL, []byte("{}"), "testacme", chal.URL)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		prob, err := ParseProblem(resp)
+		require.NoError(t, err)
+		assert.Equal(t, acmeErrorNS+"badNonce", prob.Type, "should reject unknown nonce")
+
+		resp, _ = signedPost(t, pebble, user, chal.URL, []byte("{}"), newNonce(t, pebble), pebble.Server().URL+pebbleNewOrderPath)
+		prob, err = ParseProblem(resp)
+		require.NoError(t, err)
+		assert.Equal(t, acmeErrorNS+"malformed", prob.Type, "should reject incorrect url")
+
+		authz, err = api.Authorizations.Get(order.Authorizations[0])
+		require.NoError(t, err)
+		assert.Equal(t, "pending", authz.Challenges[0].Status, "should not request the challenge")
+	})
+
+	t.Run("arguments", func(t *testing.T) {
+		assert.Error(t, pebble.ResolveChallenge("token", ValidationValid, &Problem{}))
+		assert.Error(t, pebble.ResolveChallenge("token", "pending", nil))
+		assert.Error(t, SharedPebble().ResolveChallenge("token", ValidationValid, nil),
+			"should require manual validation")
+	})
+}
+
+func TestPebble_ResolveChallenge_Validity(t *testing.T) {
+	const validity = 3 * time.Hour
+	pebble := NewPebble(NewTestingContext(t),
+		WithPebbleManualValidation(0),
+		WithPebbleAuthorizationValidityPeriod(validity))
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+	api := LegoAPIClient(pebble, user)
+
+	order, err := api.Orders.New([]string{"validity.manual.test"})
+	require.NoError(t, err)
+	authz, err := api.Authorizations.Get(order.Authorizations[0])
+	require.NoError(t, err)
+	require.NoError(t, pebble.ResolveChallenge(authz.Challenges[0].Token, ValidationValid, nil))
+	_, err = api.Challenges.New(authz.Challenges[0].URL)
+	require.NoError(t, err)
+
+	// read from the PebbleDB, as other requests could adjust the validity.
+	stored := pebble.PebbleDB.GetAuthorizationByID(path.Base(order.Authorizations[0]))
+	require.NotNil(t, stored)
+	require.Eventually(t, func() bool {
+		stored.RLock()
+		defer stored.RUnlock()
+		return stored.Status == "valid"
+	}, 10*time.Second, 10*time.Millisecond)
+	stored.RLock()
+	expires := stored.ExpiresDate
+	stored.RUnlock()
+	assert.WithinDuration(t, time.Now().Add(validity), expires, time.Minute,
+		"should have the authorization validity period")
+}
@@ -0,0 +1,216 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/pebble/v2/ca"
+	"github.com/letsencrypt/pebble/v2/db"
+	"golang.org/x/crypto/ocsp"
+)
+
+// DefaultOCSPResponseValidity is the period for which OCSP responses are valid
+// (their nextUpdate is thisUpdate + DefaultOCSPResponseValidity).
+const DefaultOCSPResponseValidity = 24 * time.Hour
+
+// OCSPStatus is the status of a certificate reported by the OCSP responder.
+type OCSPStatus int
+
+const (
+	// OCSPGood reports the certificate as good.
+	OCSPGood OCSPStatus = ocsp.Good
+	// OCSPRevoked reports the certificate as revoked.
+	OCSPRevoked OCSPStatus = ocsp.Revoked
+	// OCSPUnknown reports the certificate as unknown to the responder.
+	OCSPUnknown OCSPStatus = ocsp.Unknown
+)
+
+// ocspResponder answers OCSP requests for certificates issued by the testacme
+// CA, reading their status from the PebbleDB unless forced otherwise.
+type ocspResponder struct {
+	db    *db.MemoryStore
+	clock *Clock
+	// signer provides the leaf issuing intermediate certificate and key.
+	signer func() (*x509.Certificate, crypto.Signer)
+
+	mu     sync.Mutex
+	forced map[string]OCSPStatus
+}
+
+func newOCSPResponder(store *db.MemoryStore, clock *Clock, signer func() (*x509.Certificate, crypto.Signer)) *ocspResponder {
+	return &ocspResponder{
+		db:     store,
+		clock:  clock,
+		signer: signer,
+		forced: map[string]OCSPStatus{},
+	}
+}
+
+// pebbleCASigner signs with Pebble's leaf issuing intermediate, which is
+// shared by all of its chains.
+func pebbleCASigner(pebbleCA *ca.CAImpl) func() (*x509.Certificate, crypto.Signer) {
+	return func() (*x509.Certificate, crypto.Signer) {
+		return pebbleCA.GetIntermediateCert(0).Cert, pebbleCA.GetIntermediateKey(0)
+	}
+}
+
+// Force reports the status for the certificate with the given serial number,
+// regardless of its actual status.
+func (or *ocspResponder) Force(serial *big.Int, status OCSPStatus) {
+	or.mu.Lock()
+	defer or.mu.Unlock()
+
+	or.forced[serial.Text(16)] = status
+}
+
+// Reset reports the actual status for the certificate with the given serial
+// number.
+func (or *ocspResponder) Reset(serial *big.Int) {
+	or.mu.Lock()
+	defer or.mu.Unlock()
+
+	delete(or.forced, serial.Text(16))
+}
+
+// template provides the response for the certificate with the given serial
+// number.
+func (or *ocspResponder) template(serial *big.Int) ocsp.Response {
+	now := or.clock.Now().UTC().Truncate(time.Second)
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: serial,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(DefaultOCSPResponseValidity),
+	}
+
+	if revoked := or.db.GetRevokedCertificateBySerial(serial); revoked != nil {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = revoked.RevokedAt.Add(or.clock.Offset()).UTC().Truncate(time.Second)
+		if revoked.Reason != nil {
+			template.RevocationReason = int(*revoked.Reason)
+		}
+	} else if or.db.GetCertificateBySerial(serial) != nil {
+		template.Status = ocsp.Good
+	}
+
+	or.mu.Lock()
+	forced, ok := or.forced[serial.Text(16)]
+	or.mu.Unlock()
+	if ok && OCSPStatus(template.Status) != forced {
+		template.Status = int(forced)
+		if forced == OCSPRevoked {
+			template.RevokedAt = now
+			template.RevocationReason = ocsp.Unspecified
+		}
+	}
+
+	return template
+}
+
+// ServeHTTP answers OCSP requests made with either GET or POST.
+//
+// https://www.rfc-editor.org/rfc/rfc6960.html#appendix-A.1
+func (or *ocspResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var der []byte
+	switch r.Method {
+	case http.MethodGet:
+		path, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/"))
+		if err == nil {
+			der, err = base64.StdEncoding.DecodeString(path)
+		}
+		if err != nil {
+			or.respond(w, ocsp.MalformedRequestErrorResponse)
+			return
+		}
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+		if err != nil {
+			or.respond(w, ocsp.MalformedRequestErrorResponse)
+			return
+		}
+		der = body
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := ocsp.ParseRequest(der)
+	if err != nil {
+		or.respond(w, ocsp.MalformedRequestErrorResponse)
+		return
+	}
+
+	issuer, key := or.signer()
+	if !bytes.Equal(req.IssuerKeyHash, issuerKeyHash(issuer, req.HashAlgorithm)) {
+		// not a certificate issued by this CA.
+		or.respond(w, ocsp.UnauthorizedErrorResponse)
+		return
+	}
+
+	resp, err := ocsp.CreateResponse(issuer, issuer, or.template(req.SerialNumber), key)
+	if err != nil {
+		or.respond(w, ocsp.InternalErrorErrorResponse)
+		return
+	}
+
+	or.respond(w, resp)
+}
+
+func (or *ocspResponder) respond(w http.ResponseWriter, resp []byte) {
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// issuerKeyHash hashes the issuer's public key, as used in OCSP requests to
+// identify the issuer.
+func issuerKeyHash(issuer *x509.Certificate, hash crypto.Hash) []byte {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil || !hash.Available() {
+		return nil
+	}
+
+	h := hash.New()
+	h.Write(spki.PublicKey.RightAlign())
+	return h.Sum(nil)
+}
+
+// OCSPServer provides the OCSP responder server, its URL is included in
+// certificates issued by the testacme CA. The server is started before
+// returned, if not already started.
+//
+// Note that responses can't be signed by Ed25519 CA keys (eg: as set with
+// WithPebbleCAKeyType), an internalError response is sent instead.
+func (p Pebble) OCSPServer() *httptest.Server {
+	p.ocspServerStart.Do(p.ocspServer.Start)
+	return p.ocspServer
+}
+
+// ForceOCSPStatus reports the status for the certificate with the given serial
+// number from the OCSP responder, regardless of its actual status.
+func (p Pebble) ForceOCSPStatus(serial *big.Int, status OCSPStatus) {
+	p.ocspResponder.Force(serial, status)
+}
+
+// ResetOCSPStatus reports the actual status for the certificate with the given
+// serial number from the OCSP responder.
+func (p Pebble) ResetOCSPStatus(serial *big.Int) {
+	p.ocspResponder.Reset(serial)
+}
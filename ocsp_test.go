@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestPebble_OCSPResponder(t *testing.T) {
+	pebble := SharedPebble()
+
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+	resource, err := LegoClient(pebble, user).Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{"responder.ocsp.test"},
+		Bundle:  true,
+	})
+	require.NoError(t, err)
+	certs, err := certcrypto.ParsePEMBundle(resource.Certificate)
+	require.NoError(t, err)
+	leaf, issuer := certs[0], certs[1]
+
+	require.Equal(t, []string{pebble.OCSPServer().URL}, leaf.OCSPServer, "should include responder in AIA")
+
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	require.NoError(t, err)
+
+	query := func(t *testing.T, get bool) *ocsp.Response {
+		var resp *http.Response
+		var err error
+		if get {
+			resp, err = http.Get(pebble.OCSPServer().URL + "/" + base64.StdEncoding.EncodeToString(request))
+		} else {
+			resp, err = http.Post(pebble.OCSPServer().URL, "application/ocsp-request", bytes.NewReader(request))
+		}
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		parsed, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+		require.NoError(t, err)
+		return parsed
+	}
+
+	assert.Equal(t, ocsp.Good, query(t, false).Status)
+	assert.Equal(t, ocsp.Good, query(t, true).Status, "should answer GET requests")
+
+	pebble.ForceOCSPStatus(leaf.SerialNumber, OCSPRevoked)
+	revoked := query(t, false)
+	assert.Equal(t, ocsp.Revoked, revoked.Status)
+	assert.Equal(t, ocsp.Unspecified, revoked.RevocationReason)
+
+	pebble.ForceOCSPStatus(leaf.SerialNumber, OCSPUnknown)
+	assert.Equal(t, ocsp.Unknown, query(t, false).Status)
+
+	pebble.ResetOCSPStatus(leaf.SerialNumber)
+	assert.Equal(t, ocsp.Good, query(t, false).Status)
+
+	t.Run("unknown issuer", func(t *testing.T) {
+		other := &x509.Certificate{RawSubjectPublicKeyInfo: leaf.RawSubjectPublicKeyInfo, RawSubject: leaf.RawSubject}
+		request, err := ocsp.CreateRequest(leaf, other, nil)
+		require.NoError(t, err)
+
+		resp, err := http.Post(pebble.OCSPServer().URL, "application/ocsp-request", bytes.NewReader(request))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		_, err = ocsp.ParseResponse(body, nil)
+		assert.Equal(t, ocsp.ResponseError{Status: ocsp.Unauthorized}, err)
+	})
+}
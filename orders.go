@@ -0,0 +1,182 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"path"
+	"time"
+
+	"github.com/letsencrypt/pebble/v2/acme"
+	"github.com/letsencrypt/pebble/v2/core"
+)
+
+// Identifier is an ACME identifier, such as a DNS name.
+//
+// https://www.rfc-editor.org/rfc/rfc8555.html#section-9.7.7
+type Identifier struct {
+	// Type is the identifier type, eg: `dns`.
+	Type string `json:"type"`
+	// Value is the identifier, eg: the DNS name.
+	Value string `json:"value"`
+}
+
+// Order is a snapshot of an order's state, as held by the testacme server.
+type Order struct {
+	// URL is the order's URL in the ACME API.
+	URL         string
+	Status      string
+	Identifiers []Identifier
+	Expires     time.Time
+	// Error is the problem that invalidated the order, if any.
+	Error          *Problem
+	Authorizations []Authorization
+}
+
+// Authorization is a snapshot of an authorization's state, as held by the
+// testacme server.
+type Authorization struct {
+	// URL is the authorization's URL in the ACME API.
+	URL        string
+	Status     string
+	Identifier Identifier
+	Wildcard   bool
+	Expires    time.Time
+	Challenges []Challenge
+}
+
+// Challenge is a snapshot of a challenge's state, as held by the testacme
+// server.
+type Challenge struct {
+	// URL is the challenge's URL in the ACME API.
+	URL    string
+	Type   string
+	Token  string
+	Status string
+	// Validated is the time the challenge was validated, if it has been.
+	Validated time.Time
+	// Error is the problem found validating the challenge, if any.
+	Error *Problem
+}
+
+// Orders provides snapshots of the account's orders, read from the PebbleDB.
+// The account is given by its URL, as returned when registering.
+func (p Pebble) Orders(accountURL string) []Order {
+	baseURL := p.Server().URL
+	if p.authorizations != nil {
+		p.authorizations.adjustValidity()
+	}
+
+	var orders []Order
+	for _, order := range p.PebbleDB.GetOrdersByAccountID(path.Base(accountURL)) {
+		orders = append(orders, orderSnapshot(baseURL, order))
+	}
+	return orders
+}
+
+// Authorizations provides snapshots of the authorizations of the account's
+// orders, followed by its pre-authorizations, read from the PebbleDB.
+// Authorizations reused by several orders are only given once.
+func (p Pebble) Authorizations(accountURL string) []Authorization {
+	seen := map[string]bool{}
+
+	var authzs []Authorization
+	for _, order := range p.Orders(accountURL) {
+		for _, authz := range order.Authorizations {
+			if !seen[authz.URL] {
+				seen[authz.URL] = true
+				authzs = append(authzs, authz)
+			}
+		}
+	}
+	for _, preauthz := range p.tracker.Preauthorizations() {
+		preauthz.RLock()
+		order := preauthz.Order
+		preauthz.RUnlock()
+		order.RLock()
+		accountID := order.AccountID
+		order.RUnlock()
+		if accountID != path.Base(accountURL) {
+			continue
+		}
+
+		authz := authorizationSnapshot(p.Server().URL, preauthz)
+		if !seen[authz.URL] {
+			seen[authz.URL] = true
+			authzs = append(authzs, authz)
+		}
+	}
+	return authzs
+}
+
+// Challenges provides snapshots of the challenges of the account's
+// authorizations, read from the PebbleDB.
+func (p Pebble) Challenges(accountURL string) []Challenge {
+	var challenges []Challenge
+	for _, authz := range p.Authorizations(accountURL) {
+		challenges = append(challenges, authz.Challenges...)
+	}
+	return challenges
+}
+
+func orderSnapshot(baseURL string, order *core.Order) Order {
+	order.RLock()
+	defer order.RUnlock()
+
+	snapshot := Order{
+		URL:     baseURL + pebbleOrderPath + order.ID,
+		Status:  order.Status,
+		Expires: order.ExpiresDate,
+		Error:   fromPebbleProblem(order.Error),
+	}
+	for _, ident := range order.Identifiers {
+		snapshot.Identifiers = append(snapshot.Identifiers, Identifier(ident))
+	}
+	for _, authz := range order.AuthorizationObjects {
+		snapshot.Authorizations = append(snapshot.Authorizations, authorizationSnapshot(baseURL, authz))
+	}
+	return snapshot
+}
+
+func authorizationSnapshot(baseURL string, authz *core.Authorization) Authorization {
+	authz.RLock()
+	defer authz.RUnlock()
+
+	snapshot := Authorization{
+		URL:        baseURL + pebbleAuthzPath + authz.ID,
+		Status:     authz.Status,
+		Identifier: Identifier(authz.Identifier),
+		Wildcard:   authz.Wildcard,
+		Expires:    authz.ExpiresDate,
+	}
+	for _, chal := range authz.Challenges {
+		snapshot.Challenges = append(snapshot.Challenges, challengeSnapshot(baseURL, chal))
+	}
+	return snapshot
+}
+
+func challengeSnapshot(baseURL string, chal *core.Challenge) Challenge {
+	chal.RLock()
+	defer chal.RUnlock()
+
+	return Challenge{
+		URL:       baseURL + pebbleChallengePath + chal.ID,
+		Type:      chal.Type,
+		Token:     chal.Token,
+		Status:    chal.Status,
+		Validated: chal.ValidatedDate,
+		Error:     fromPebbleProblem(chal.Error),
+	}
+}
+
+// fromPebbleProblem provides the Problem for Pebble's problem details, nil is
+// provided for nil details.
+func fromPebbleProblem(prob *acme.ProblemDetails) *Problem {
+	if prob == nil {
+		return nil
+	}
+	return &Problem{
+		Type:   prob.Type,
+		Detail: prob.Detail,
+		Status: prob.HTTPStatus,
+	}
+}
@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"testing"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPebble_Orders(t *testing.T) {
+	pebble := SharedPebble()
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+	accountURL := user.GetRegistration().URI
+
+	assert.Empty(t, pebble.Orders(accountURL))
+
+	pending, err := LegoAPIClient(pebble, user).Orders.New([]string{"pending.orders.test"})
+	require.NoError(t, err)
+
+	orders := pebble.Orders(accountURL)
+	require.Len(t, orders, 1)
+	order := orders[0]
+	assert.Equal(t, pending.Location, order.URL)
+	assert.Equal(t, "pending", order.Status)
+	assert.Equal(t, []Identifier{{Type: "dns", Value: "pending.orders.test"}}, order.Identifiers)
+	assert.False(t, order.Expires.IsZero())
+	assert.Nil(t, order.Error)
+
+	require.Len(t, order.Authorizations, 1)
+	authz := order.Authorizations[0]
+	assert.Equal(t, pending.Authorizations[0], authz.URL)
+	assert.Equal(t, "pending", authz.Status)
+	assert.Equal(t, Identifier{Type: "dns", Value: "pending.orders.test"}, authz.Identifier)
+	assert.NotEmpty(t, authz.Challenges)
+	for _, chal := range authz.Challenges {
+		assert.Equal(t, "pending", chal.Status)
+		assert.NotEmpty(t, chal.Token)
+		assert.True(t, chal.Validated.IsZero())
+	}
+
+	_, err = LegoClient(pebble, user).Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{"valid.orders.test"},
+	})
+	require.NoError(t, err)
+
+	orders = pebble.Orders(accountURL)
+	require.Len(t, orders, 2, "should include the order created by Obtain")
+	var valid *Order
+	for i := range orders {
+		if orders[i].Identifiers[0].Value == "valid.orders.test" {
+			valid = &orders[i]
+		}
+	}
+	require.NotNil(t, valid)
+	assert.Equal(t, "valid", valid.Status)
+	assert.Equal(t, "valid", valid.Authorizations[0].Status)
+
+	var validated []Challenge
+	for _, chal := range pebble.Challenges(accountURL) {
+		if chal.Status == "valid" {
+			validated = append(validated, chal)
+		}
+	}
+	require.Len(t, validated, 1)
+	assert.False(t, validated[0].Validated.IsZero())
+
+	assert.Len(t, pebble.Authorizations(accountURL), 2)
+}
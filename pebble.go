@@ -4,6 +4,7 @@ package testacme
 
 import (
 	"context"
+	"crypto/x509/pkix"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -42,6 +43,37 @@ func unsetPebbleEnvs() {
 	os.Unsetenv("PEBBLE_CHAIN_LENGTH")
 }
 
+// Pebble API paths, most of which aren't exported by the wfe package.
+//
+// https://github.com/letsencrypt/pebble/blob/v2.4.0/wfe/wfe.go#L41-L63
+const (
+	pebbleNoncePath       = "/nonce-plz"
+	pebbleNewAccountPath  = "/sign-me-up"
+	pebbleAccountPath     = "/my-account/"
+	pebbleNewOrderPath    = "/order-plz"
+	pebbleOrderPath       = "/my-order/"
+	pebbleFinalizePath    = "/finalize-order/"
+	pebbleAuthzPath       = "/authZ/"
+	pebbleChallengePath   = "/chalZ/"
+	pebbleCertPath        = "/certZ/"
+	pebbleRevokeCertPath  = "/revoke-cert"
+	pebbleKeyRolloverPath = "/rollover-account-key"
+	pebbleListOrdersPath  = "/list-orderz/"
+
+	// testacme extensions to Pebble's API.
+	pebbleRenewalInfoPath = "/renewal-info/"
+	pebbleNewAuthzPath    = "/new-authz"
+
+	pebbleRootCertPath           = wfe.RootCertPath
+	pebbleRootKeyPath            = "/root-keys/"
+	pebbleIntermediateCertPath   = "/intermediates/"
+	pebbleIntermediateKeyPath    = "/intermediate-keys/"
+	pebbleCertStatusBySerialPath = "/cert-status-by-serial/"
+
+	// testacme extensions to Pebble's management API.
+	pebbleRevokeBySerialPath = "/revoke-cert-by-serial/"
+)
+
 // PebbleServerConfig provides configuration used to stand up the Pebble
 // testacme instance. Note that callers *can* make an inconsistent setup by
 // explicitly building up their CA, VA, and DB values.. so take care when being
@@ -76,6 +108,53 @@ type PebbleServerConfig struct {
 	// generated Root CA chains. Setting this to `1` generates *only* Root CA
 	// certificate(s) while `2` would include a single Intermediate CA.
 	CertificateChainLength int `json:"certificate-chain-length"`
+
+	// CARootSubject is the subject DN of the Root CA certificates in every
+	// chain. A name is generated when left empty.
+	CARootSubject pkix.Name `json:"ca-root-subject"`
+	// CAIntermediateSubject is the subject DN of the (leaf issuing)
+	// Intermediate CA certificates in every chain. A name is generated when
+	// left empty.
+	CAIntermediateSubject pkix.Name `json:"ca-intermediate-subject"`
+	// CAKeyType is the key algorithm of generated CA keys. Pebble's RSA-2048
+	// keys are used when left empty.
+	CAKeyType CAKeyType `json:"ca-key-type"`
+	// CAIssuingCertificateURLs are the AIA CA Issuers URLs included in
+	// certificates issued by the testacme CA.
+	CAIssuingCertificateURLs []string `json:"ca-issuing-certificate-urls"`
+	// CAOCSPServerURLs are the AIA OCSP URLs included in certificates issued
+	// by the testacme CA.
+	CAOCSPServerURLs []string `json:"ca-ocsp-server-urls"`
+	// CACRLDistributionPoints are the CRL distribution point URLs included in
+	// certificates issued by the testacme CA.
+	CACRLDistributionPoints []string `json:"ca-crl-distribution-points"`
+	// CRLNextUpdate is the period for which published CRLs are valid, CRLs
+	// are only published when set.
+	CRLNextUpdate time.Duration `json:"crl-next-update"`
+
+	// AuthorizationReuse is whether an account's valid authorizations are
+	// reused for its new orders, Pebble reuses them half of the time when left
+	// empty.
+	AuthorizationReuse AuthorizationReuse `json:"authorization-reuse"`
+	// AuthorizationValidityPeriod is the duration for which validated
+	// authorizations are valid for, Pebble's hour is used when left unset.
+	AuthorizationValidityPeriod time.Duration `json:"authorization-validity-period"`
+	// PreAuthorization exposes a `newAuthz` endpoint in the directory.
+	PreAuthorization bool `json:"pre-authorization"`
+}
+
+// customCA is true when the CA is configured with settings that Pebble
+// doesn't support itself. Certificates are then issued by the testacme CA in
+// place of Pebble's, same as with WithPebbleCAKeys or WithPebbleCASeed - no
+// other options replace Pebble's CA.
+func (c PebbleServerConfig) customCA() bool {
+	return c.CARootSubject.String() != "" ||
+		c.CAIntermediateSubject.String() != "" ||
+		c.CAKeyType != "" ||
+		len(c.CAIssuingCertificateURLs) > 0 ||
+		len(c.CAOCSPServerURLs) > 0 ||
+		len(c.CACRLDistributionPoints) > 0 ||
+		c.CRLNextUpdate > 0
 }
 
 const (
@@ -107,6 +186,34 @@ type pebbleConfig struct {
 	PebbleDB *db.MemoryStore
 	// PebbleWFE provides the HTTP API for the testacme service.
 	PebbleWFE *wfe.WebFrontEndImpl
+
+	// clock is the testacme Clock used for certificates and expiry, if any.
+	clock *Clock
+	// caKeys is the CA key material provided with options, if any.
+	caKeys *caKeys
+	// issuer re-issues PebbleCA's certificates when CA key material is
+	// provided or the CA is customized, see customCA.
+	issuer *issuer
+	// ocspServer is the (un-started) OCSP responder server, its URL is given
+	// to the CA for issued certificates.
+	ocspServer *httptest.Server
+	// crlServer is the (un-started) CRL server, when enabled.
+	crlServer *httptest.Server
+	// faults are injected into ACME API responses, if any.
+	faults *Faults
+	// rateLimits are enforced on the ACME API, if any.
+	rateLimits *RateLimits
+	// testLog collects the services' logs for the test, if set.
+	testLog *testLog
+	// manualValidation is the hold period of manually validated challenges,
+	// challenges are validated by Pebble's VA when nil.
+	manualValidation *time.Duration
+	// identifierPolicies reject identifiers before orders are created for
+	// them.
+	identifierPolicies []IdentifierPolicy
+	// transcriptLimit is the number of ACME API requests and responses kept
+	// in the transcript, defaultTranscriptLimit when nil.
+	transcriptLimit *int
 }
 
 // newPebbleConfig initializes the pebbleConfig and provides a finalization
@@ -146,6 +253,9 @@ func newPebbleConfig(ctx context.Context) (*pebbleConfig, func()) {
 			target.PebbleServerConfig.TLSVerificationPort = port.Int()
 		}
 
+		if target.PebbleLogger == nil && target.testLog != nil {
+			target.PebbleLogger = target.testLog.Logger("pebble")
+		}
 		if target.PebbleLogger == nil {
 			// If you want logs, then you're going to have to configure a
 			// logger.
@@ -153,7 +263,25 @@ func newPebbleConfig(ctx context.Context) (*pebbleConfig, func()) {
 			logger.SetOutput(ioutil.Discard)
 			target.PebbleLogger = &logger
 		}
+		// componentLogger provides the logger for each of the Pebble
+		// services.
+		componentLogger := func(component string) *log.Logger {
+			if target.testLog != nil {
+				return target.testLog.Logger(component)
+			}
+			return target.PebbleLogger
+		}
 
+		if target.PebbleServerConfig.VerificationDNSResolver == "" && target.testLog != nil {
+			db := SharedNameserverDB()
+			nameserver, err := newDNS(ctx, db, dnsLogHandler{handler: db, log: target.testLog.Logger("dns")})
+			if err != nil {
+				panic(fmt.Sprintf("cannot start DNS server: %v", err))
+			}
+			// The nameserver logs through the test, so must stop with it.
+			nameserver.shutdownWith(ctx)
+			target.PebbleServerConfig.VerificationDNSResolver = nameserver.Addr().String()
+		}
 		if target.PebbleServerConfig.VerificationDNSResolver == "" {
 			// NOTE: could also create a new server for each.. meh.
 			target.PebbleServerConfig.VerificationDNSResolver = SharedDNS().Addr().String()
@@ -168,11 +296,46 @@ func newPebbleConfig(ctx context.Context) (*pebbleConfig, func()) {
 			target.PebbleDB = db.NewMemoryStore()
 		}
 
+		// The listener is bound now so its URL may be included in issued
+		// certificates, the handler is set up with the other servers.
+		target.ocspServer = httptest.NewUnstartedServer(nil)
+		ocspURL := "http://" + target.ocspServer.Listener.Addr().String()
+
+		if (target.caKeys != nil || target.PebbleServerConfig.customCA()) && target.issuer == nil {
+			issuer, err := newIssuer(
+				target.PebbleDB,
+				target.caKeys,
+				target.PebbleServerConfig)
+			if err != nil {
+				panic(fmt.Sprintf("cannot create CA issuer: %v", err))
+			}
+			target.issuer = issuer
+		}
+
+		if target.PebbleServerConfig.CRLNextUpdate > 0 {
+			target.crlServer = httptest.NewUnstartedServer(nil)
+			if len(target.PebbleServerConfig.CACRLDistributionPoints) == 0 {
+				// leaves are all issued by the first chain's intermediate.
+				target.issuer.crlURLs = []string{"http://" + target.crlServer.Listener.Addr().String() + "/0"}
+			}
+		}
+
+		if target.PebbleCA == nil && target.issuer != nil {
+			// The issuer provides all of the chains, Pebble's own are
+			// never seen so keep them minimal.
+			target.PebbleCA = ca.New(
+				componentLogger("ca"),
+				target.PebbleDB,
+				ocspURL,
+				0, 1,
+				uint(target.PebbleServerConfig.CertificateValidityPeriod.Seconds()))
+		}
+
 		if target.PebbleCA == nil {
 			target.PebbleCA = ca.New(
-				target.PebbleLogger,
+				componentLogger("ca"),
 				target.PebbleDB,
-				"",
+				ocspURL,
 				target.PebbleServerConfig.CertificateAlternateChains,
 				target.PebbleServerConfig.CertificateChainLength,
 				uint(target.PebbleServerConfig.CertificateValidityPeriod.Seconds()))
@@ -180,7 +343,7 @@ func newPebbleConfig(ctx context.Context) (*pebbleConfig, func()) {
 
 		if target.PebbleVA == nil {
 			target.PebbleVA = va.New(
-				target.PebbleLogger,
+				componentLogger("va"),
 				target.PebbleServerConfig.HTTPVerificationPort,
 				target.PebbleServerConfig.TLSVerificationPort,
 				// "strict" doesn't seem used in v2.4.0
@@ -193,7 +356,7 @@ func newPebbleConfig(ctx context.Context) (*pebbleConfig, func()) {
 		if target.PebbleWFE == nil {
 			// NOTE: this re-seeds via `rand.Seed`
 			frontend := wfe.New(
-				target.PebbleLogger,
+				componentLogger("wfe"),
 				target.PebbleDB,
 				target.PebbleVA,
 				target.PebbleCA,
@@ -242,6 +405,44 @@ func WithPebbleDNS(dns *DNS) PebbleOption {
 	}
 }
 
+// WithPebbleCASubjects uses the provided subject DNs for the Root and (leaf
+// issuing) Intermediate CA certificates in every chain. Pebble's CA can't be
+// configured this way, so certificates are issued by the testacme CA instead.
+func WithPebbleCASubjects(root, intermediate pkix.Name) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		pc.PebbleServerConfig.CARootSubject = root
+		pc.PebbleServerConfig.CAIntermediateSubject = intermediate
+		return nil
+	}
+}
+
+// WithPebbleCAKeyType generates CA keys with the provided key algorithm.
+// Pebble's CA only uses RSA keys, so certificates are issued by the testacme
+// CA instead.
+func WithPebbleCAKeyType(keyType CAKeyType) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		switch keyType {
+		case CAKeyRSA2048, CAKeyRSA4096, CAKeyP256, CAKeyP384, CAKeyEd25519:
+		default:
+			return fmt.Errorf("unsupported CA key type %q", keyType)
+		}
+		pc.PebbleServerConfig.CAKeyType = keyType
+		return nil
+	}
+}
+
+// WithPebbleCAURLs includes the provided AIA (CA Issuers and OCSP) and CRL
+// distribution point URLs in certificates issued by the testacme CA, which
+// issues certificates in place of Pebble's CA.
+func WithPebbleCAURLs(issuingCertificate, ocspServer, crlDistributionPoints []string) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		pc.PebbleServerConfig.CAIssuingCertificateURLs = issuingCertificate
+		pc.PebbleServerConfig.CAOCSPServerURLs = ocspServer
+		pc.PebbleServerConfig.CACRLDistributionPoints = crlDistributionPoints
+		return nil
+	}
+}
+
 // PebbleOption are functions that tune configuration of the Pebble services.
 type PebbleOption = func(*pebbleConfig) error
 
@@ -255,11 +456,25 @@ type Pebble struct {
 	pebbleServer          *httptest.Server
 	managementServerStart *sync.Once
 	managementServer      *httptest.Server
+	ocspServerStart       *sync.Once
+	ocspResponder         *ocspResponder
+	crlServerStart        *sync.Once
+
+	verificationRouter *verificationRouter
+	tracker            *objectTracker
+	renewalInfo        *renewalInfoService
+	rateLimiter        *rateLimiter
+	transcript         *transcriptRecorder
+	manualValidator    *manualValidator
+	authorizations     *authorizationService
 }
 
 // Pebble provides its verification port numbers.
 var _ Porter = (*Pebble)(nil)
 
+// Pebble's Clock may be controlled, when set with WithPebbleClock.
+var _ ClockController = (*Pebble)(nil)
+
 // NewPebble creates an initialized, un-started, Pebble testacme server. The
 // services are automatically shutdown with respect to the given context. Also
 // see `SharedPebble()`.
@@ -275,8 +490,95 @@ func NewPebble(ctx context.Context, options ...PebbleOption) Pebble {
 	finalize()
 
 	testacmeCtx, cancel := context.WithCancel(config.Context)
-	server := httptest.NewUnstartedServer(config.PebbleWFE.Handler())
-	managementServer := httptest.NewUnstartedServer(config.PebbleWFE.ManagementHandler())
+	tracker := new(objectTracker)
+	renewalInfo := newRenewalInfoService(config.PebbleDB, config.clock)
+	var handlers []middleware
+	var transcript *transcriptRecorder
+	transcriptLimit := defaultTranscriptLimit
+	if config.transcriptLimit != nil {
+		transcriptLimit = *config.transcriptLimit
+	}
+	if transcriptLimit > 0 {
+		transcript = &transcriptRecorder{clock: config.clock, limit: transcriptLimit}
+		handlers = append(handlers, transcript.WrapHandler)
+	}
+	if config.faults != nil {
+		handlers = append(handlers, config.faults.WrapHandler)
+	}
+	handlers = append(handlers, tracker.WrapHandler)
+	if len(config.identifierPolicies) > 0 {
+		policyEnforcer := newIdentifierPolicyEnforcer(config.identifierPolicies, config.PebbleDB,
+			config.PebbleServerConfig.PreAuthorization)
+		handlers = append(handlers, policyEnforcer.WrapHandler)
+	}
+	var rateLimiter *rateLimiter
+	if config.rateLimits != nil {
+		rateLimiter = newRateLimiter(*config.rateLimits, config.PebbleDB, config.clock)
+		handlers = append(handlers, rateLimiter.WrapHandler)
+	}
+	managementHandlers := []middleware{
+		routeHandler(pebbleRevokeBySerialPath, revokeBySerialHandler(config.PebbleDB, tracker)),
+	}
+	if config.clock != nil {
+		handlers = append(handlers, clockHandler(config.clock, config.PebbleDB))
+	}
+	var manualValidator *manualValidator
+	if config.manualValidation != nil {
+		manualValidator = newManualValidator(config.PebbleDB, *config.manualValidation, config.clock)
+		handlers = append(handlers, manualValidator.WrapHandler)
+	}
+	directory := map[string]string{
+		"renewalInfo": pebbleRenewalInfoPath,
+	}
+	var authorizations *authorizationService
+	if config.PebbleServerConfig.AuthorizationValidityPeriod > 0 ||
+		config.PebbleServerConfig.AuthorizationReuse != AuthorizationReuseDefault ||
+		config.PebbleServerConfig.PreAuthorization {
+		authorizations = newAuthorizationService(config.PebbleDB, tracker,
+			config.PebbleServerConfig.AuthorizationValidityPeriod,
+			config.PebbleServerConfig.AuthorizationReuse,
+			config.PebbleServerConfig.PreAuthorization)
+		handlers = append(handlers, authorizations.WrapHandler)
+		if manualValidator != nil {
+			manualValidator.validated = authorizations.adjustValidity
+		}
+		if config.PebbleServerConfig.PreAuthorization {
+			directory["newAuthz"] = pebbleNewAuthzPath
+		}
+	}
+	handlers = append(handlers,
+		directoryHandler(directory),
+		routeHandler(pebbleRenewalInfoPath, renewalInfo))
+	if config.issuer != nil {
+		handlers = append(handlers, config.issuer.WrapHandler)
+		managementHandlers = append(managementHandlers, config.issuer.WrapManagementHandler)
+	}
+	handler := wrapHandler(config.PebbleWFE.Handler(), handlers...)
+	managementHandler := wrapHandler(config.PebbleWFE.ManagementHandler(), managementHandlers...)
+
+	ocspSigner := pebbleCASigner(config.PebbleCA)
+	if config.issuer != nil {
+		ocspSigner = config.issuer.Signer
+	}
+	ocspResponder := newOCSPResponder(config.PebbleDB, config.clock, ocspSigner)
+	config.ocspServer.Config.Handler = ocspResponder
+	if config.crlServer != nil {
+		config.crlServer.Config.Handler = newCRLService(config.PebbleDB, config.issuer, tracker, config.clock,
+			config.PebbleServerConfig.CRLNextUpdate)
+	}
+
+	stopClock := func() {}
+	if config.clock != nil {
+		stopClock = config.clock.observe(func(d time.Duration) {
+			shiftExpiries(config.PebbleDB, tracker, d)
+		})
+	}
+
+	server := httptest.NewUnstartedServer(handler)
+	managementServer := httptest.NewUnstartedServer(managementHandler)
+	verificationRouter := newVerificationRouter(
+		config.PebbleServerConfig.HTTPVerificationPort,
+		config.PebbleServerConfig.TLSVerificationPort)
 
 	// Shutdown the servers when the context ends.
 	go func() {
@@ -288,6 +590,12 @@ func NewPebble(ctx context.Context, options ...PebbleOption) Pebble {
 		// not a problem this library intends to solve.
 		server.Close()
 		managementServer.Close()
+		config.ocspServer.Close()
+		if config.crlServer != nil {
+			config.crlServer.Close()
+		}
+		verificationRouter.Close()
+		stopClock()
 	}()
 
 	pebble := &Pebble{
@@ -299,6 +607,17 @@ func NewPebble(ctx context.Context, options ...PebbleOption) Pebble {
 		managementServer:      managementServer,
 		pebbleServerStart:     new(sync.Once),
 		managementServerStart: new(sync.Once),
+		ocspServerStart:       new(sync.Once),
+		crlServerStart:        new(sync.Once),
+		ocspResponder:         ocspResponder,
+
+		verificationRouter: verificationRouter,
+		tracker:            tracker,
+		renewalInfo:        renewalInfo,
+		rateLimiter:        rateLimiter,
+		transcript:         transcript,
+		manualValidator:    manualValidator,
+		authorizations:     authorizations,
 	}
 
 	return *pebble
@@ -308,6 +627,8 @@ func NewPebble(ctx context.Context, options ...PebbleOption) Pebble {
 func (p Pebble) Start() {
 	p.Server()
 	p.ManagementServer()
+	p.OCSPServer()
+	p.CRLServer()
 }
 
 // Shutdown will stop all Pebble servers. This does *not* block on shutdown and
@@ -317,8 +638,11 @@ func (p Pebble) Shutdown() {
 }
 
 // Server provides the testacme (Pebble) server to be used ibn tests. The server
-// is started before returned, if not already started.
+// is started before returned, if not already started. The OCSP responder and
+// CRL servers are also started, issued certificates point at them.
 func (p Pebble) Server() *httptest.Server {
+	p.OCSPServer()
+	p.CRLServer()
 	p.pebbleServerStart.Do(p.pebbleServer.StartTLS)
 	return p.pebbleServer
 }
@@ -358,3 +682,42 @@ func (p Pebble) HTTPVerificationPort() int {
 func (p Pebble) TLSVerificationPort() int {
 	return p.PebbleServerConfig.TLSVerificationPort
 }
+
+// Clock provides the Clock used by the testacme services, set with
+// WithPebbleClock. Pebble uses the system clock when nil.
+func (p Pebble) Clock() *Clock {
+	return p.clock
+}
+
+// RouteHTTPVerification routes HTTP challenge verification requests for host,
+// as made to the HTTPVerificationPort, to the given backend address. This
+// permits several independent servers to answer challenges in one test.
+//
+// Routes are registered on the SharedHTTP01Responder for the port, so routed
+// hosts and challenges answered by the responder (eg: by LegoClient) share the
+// verification port. Challenge servers must listen on their own backend
+// address. Hosts may only be routed once at a time, an error is returned when
+// the host is already routed.
+func (p Pebble) RouteHTTPVerification(host, backend string) error {
+	return p.verificationRouter.RouteHTTP(host, backend)
+}
+
+// RouteTLSVerification routes TLS challenge verification connections for host
+// (by SNI, the reverse-DNS name for IP addresses), as made to the
+// TLSVerificationPort, to the given backend address. This permits several
+// independent servers to answer challenges in one test.
+//
+// Routes are registered on the SharedTLSALPN01Responder for the port, so
+// routed hosts and challenges answered by the responder (eg: by LegoClient)
+// share the verification port. Challenge servers must listen on their own
+// backend address.
+func (p Pebble) RouteTLSVerification(host, backend string) error {
+	return p.verificationRouter.RouteTLS(host, backend)
+}
+
+// RemoveVerificationRoutes removes both HTTP and TLS verification routes for
+// host. The verification ports are released once no routes (or shared
+// responder registrations) remain.
+func (p Pebble) RemoveVerificationRoutes(host string) {
+	p.verificationRouter.Remove(host)
+}
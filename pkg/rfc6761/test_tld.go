@@ -26,3 +26,21 @@ func CanonicalTest(dn string) string {
 		return n + "test."
 	}
 }
+
+// RegisteredDomain provides the registered domain of dn, the name one label
+// below its TLD (as a public suffix), eg: `foo.bar.test` is registered under
+// `bar.test`. The name is returned as-is when it has no more than two labels.
+func RegisteredDomain(dn string) string {
+	labels := dns.SplitDomainName(strings.ToLower(dn))
+	if len(labels) > 2 {
+		labels = labels[len(labels)-2:]
+	}
+	return strings.Join(labels, ".")
+}
+
+// IsTest is true when dn is a name under the TestTLD, eg: `foo.test` or
+// `*.foo.test`. The TestTLD itself isn't a name under it.
+func IsTest(dn string) bool {
+	labels := dns.SplitDomainName(strings.ToLower(dn))
+	return len(labels) > 1 && labels[len(labels)-1] == TestTLD
+}
@@ -24,3 +24,39 @@ func TestCanonicalTest(t *testing.T) {
 		})
 	}
 }
+
+func TestRegisteredDomain(t *testing.T) {
+	testcases := map[string]string{
+		"foo.bar.test":    "bar.test",
+		"Foo.Bar.test.":   "bar.test",
+		"*.foo.bar.test":  "bar.test",
+		"bar.test":        "bar.test",
+		"a.b.example.com": "example.com",
+		"test":            "test",
+	}
+
+	for input, expected := range testcases {
+		t.Run(input, func(t *testing.T) {
+			assert.Equal(t, expected, RegisteredDomain(input))
+		})
+	}
+}
+
+func TestIsTest(t *testing.T) {
+	testcases := map[string]bool{
+		"foo.test":      true,
+		"Foo.Bar.TEST.": true,
+		"*.foo.test":    true,
+		"test":          false,
+		"latest":        false,
+		"foo.latest":    false,
+		"foo.test.com":  false,
+		"":              false,
+	}
+
+	for input, expected := range testcases {
+		t.Run(input, func(t *testing.T) {
+			assert.Equal(t, expected, IsTest(input))
+		})
+	}
+}
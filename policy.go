@@ -0,0 +1,214 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/letsencrypt/pebble/v2/acme"
+	"github.com/letsencrypt/pebble/v2/db"
+
+	"github.com/jahkeup/testacme/pkg/rfc6761"
+)
+
+// IdentifierPolicy decides whether the testacme server issues certificates for
+// the identifier, returning an error to reject it. The error is reported as a
+// `rejectedIdentifier` subproblem, or as the subproblem itself when it's a
+// *Problem, eg: for an `unsupportedIdentifier` problem.
+type IdentifierPolicy func(Identifier) error
+
+// TestTLDPolicy rejects DNS names that aren't under the `.test` TLD reserved
+// by rfc6761. Other identifiers, such as IP addresses, are permitted.
+func TestTLDPolicy(ident Identifier) error {
+	if ident.Type == acme.IdentifierDNS && !rfc6761.IsTest(ident.Value) {
+		return fmt.Errorf("policy only permits names under .%s", rfc6761.TestTLD)
+	}
+	return nil
+}
+
+// DenyListPolicy rejects identifiers with any of the values, compared without
+// regard to case or a trailing dot, eg: `blocked.test` or `127.0.0.1`. IP
+// addresses are compared as addresses, so `::1` denies `0::1`.
+func DenyListPolicy(values ...string) IdentifierPolicy {
+	denied := map[string]struct{}{}
+	var deniedIPs []net.IP
+	for _, value := range values {
+		denied[policyKey(value)] = struct{}{}
+		if ip := net.ParseIP(value); ip != nil {
+			deniedIPs = append(deniedIPs, ip)
+		}
+	}
+
+	return func(ident Identifier) error {
+		if ident.Type == acme.IdentifierIP {
+			ip := net.ParseIP(ident.Value)
+			for _, denied := range deniedIPs {
+				if denied.Equal(ip) {
+					return errors.New("policy forbids issuing for identifier")
+				}
+			}
+			return nil
+		}
+		if _, ok := denied[policyKey(ident.Value)]; ok {
+			return errors.New("policy forbids issuing for identifier")
+		}
+		return nil
+	}
+}
+
+// DenyRegexpPolicy rejects identifiers with values matching any of the
+// patterns, eg: `(^|\.)internal\.test$` for names under `internal.test`.
+// Values are matched as compared by DenyListPolicy, in lower case and without
+// a trailing dot.
+func DenyRegexpPolicy(patterns ...*regexp.Regexp) IdentifierPolicy {
+	return func(ident Identifier) error {
+		value := policyKey(ident.Value)
+		for _, pattern := range patterns {
+			if pattern.MatchString(value) {
+				return fmt.Errorf("policy forbids issuing for identifiers matching %q", pattern)
+			}
+		}
+		return nil
+	}
+}
+
+// policyKey normalizes identifier values for comparison.
+func policyKey(value string) string {
+	return strings.TrimSuffix(strings.ToLower(value), ".")
+}
+
+// identifierPolicyEnforcer rejects requests for identifiers the policies
+// reject, before Pebble creates any orders (or pre-authorizations) for them.
+type identifierPolicyEnforcer struct {
+	policies         []IdentifierPolicy
+	db               *db.MemoryStore
+	preauthorization bool
+}
+
+func newIdentifierPolicyEnforcer(policies []IdentifierPolicy, store *db.MemoryStore, preauthorization bool) *identifierPolicyEnforcer {
+	return &identifierPolicyEnforcer{
+		policies:         policies,
+		db:               store,
+		preauthorization: preauthorization,
+	}
+}
+
+// WrapHandler rejects newOrder (and newAuthz) requests for identifiers the
+// policies reject with a `rejectedIdentifier` problem. Requests that can't be
+// verified are left to Pebble to reject.
+func (pe *identifierPolicyEnforcer) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost ||
+			(r.URL.Path != pebbleNewOrderPath && !(pe.preauthorization && r.URL.Path == pebbleNewAuthzPath)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			sendProblem(w, acme.MalformedProblem("unable to read request body"))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		account, payload := verifiedJWS(pe.db, body)
+		if account == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var req struct {
+			// Identifiers are those of a newOrder request.
+			Identifiers []Identifier `json:"identifiers"`
+			// Identifier is that of a newAuthz request.
+			Identifier *Identifier `json:"identifier"`
+		}
+		if err := json.Unmarshal(payload, &req); err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		identifiers := req.Identifiers
+		if req.Identifier != nil {
+			identifiers = append(identifiers, *req.Identifier)
+		}
+
+		if prob := pe.check(identifiers); prob != nil {
+			setReplayNonce(w, next)
+			// Pebble rejects replayed, or misdirected, requests before
+			// looking at their identifiers.
+			if prob := verifyNonceAndURL(r, body, next); prob != nil {
+				sendProblem(w, prob)
+				return
+			}
+			sendCompoundProblem(w, prob)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// check provides the `rejectedIdentifier` problem, with a subproblem for each
+// identifier rejected by the policies, nil is provided when all are permitted.
+//
+// https://www.rfc-editor.org/rfc/rfc8555.html#section-6.7.1
+func (pe *identifierPolicyEnforcer) check(identifiers []Identifier) *Problem {
+	var subproblems []Subproblem
+	for _, ident := range identifiers {
+		for _, policy := range pe.policies {
+			err := policy(ident)
+			if err == nil {
+				continue
+			}
+
+			sub := Subproblem{
+				Type:       acmeErrorNS + "rejectedIdentifier",
+				Detail:     err.Error(),
+				Identifier: ProblemIdentifier(ident),
+			}
+			var prob *Problem
+			if errors.As(err, &prob) {
+				sub.Type, sub.Detail = prob.Type, prob.Detail
+			}
+			subproblems = append(subproblems, sub)
+			break
+		}
+	}
+	if len(subproblems) == 0 {
+		return nil
+	}
+
+	detail := fmt.Sprintf("Cannot issue for %q: %s", subproblems[0].Identifier.Value, subproblems[0].Detail)
+	if len(subproblems) > 1 {
+		detail = fmt.Sprintf("Cannot issue for %d identifiers, see subproblems", len(subproblems))
+	}
+	return &Problem{
+		Type:        acmeErrorNS + "rejectedIdentifier",
+		Detail:      detail,
+		Status:      http.StatusBadRequest,
+		Subproblems: subproblems,
+	}
+}
+
+// WithPebbleIdentifierPolicy rejects new orders for identifiers that any of
+// the policies reject, with a `rejectedIdentifier` problem that has a
+// subproblem for each rejected identifier. Pre-authorizations are rejected
+// alike, see WithPebblePreAuthorization.
+func WithPebbleIdentifierPolicy(policies ...IdentifierPolicy) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		for _, policy := range policies {
+			if policy == nil {
+				return errors.New("nil identifier policy")
+			}
+		}
+		pc.identifierPolicies = append(pc.identifierPolicies, policies...)
+		return nil
+	}
+}
@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPebble_IdentifierPolicy(t *testing.T) {
+	pebble := NewPebble(NewTestingContext(t),
+		WithPebblePreAuthorization(),
+		WithPebbleIdentifierPolicy(
+			TestTLDPolicy,
+			DenyListPolicy("Blocked.Policy.test."),
+			DenyRegexpPolicy(regexp.MustCompile(`(^|\.)internal\.policy\.test$`)),
+			func(ident Identifier) error {
+				if ident.Type == "ip" && ident.Value == "10.0.0.1" {
+					return &Problem{Type: acmeErrorNS + "unsupportedIdentifier", Detail: "private address"}
+				}
+				return nil
+			}))
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+	accountURL := user.GetRegistration().URI
+	api := LegoAPIClient(pebble, user)
+
+	_, err := api.Orders.New([]string{"permitted.policy.test"})
+	require.NoError(t, err)
+
+	t.Run("subproblems", func(t *testing.T) {
+		_, err := api.Orders.New([]string{
+			"permitted.policy.test",
+			"blocked.policy.test",
+			"db.internal.policy.test",
+			"policy.example.com",
+		})
+		prob, ok := AsProblem(err)
+		require.True(t, ok, "should be a problem: %v", err)
+		assert.Equal(t, acmeErrorNS+"rejectedIdentifier", prob.Type)
+		assert.Equal(t, http.StatusBadRequest, prob.Status)
+
+		var rejected []string
+		for _, sub := range prob.Subproblems {
+			assert.Equal(t, acmeErrorNS+"rejectedIdentifier", sub.Type)
+			assert.Equal(t, "dns", sub.Identifier.Type)
+			rejected = append(rejected, sub.Identifier.Value)
+		}
+		assert.Equal(t, []string{"blocked.policy.test", "db.internal.policy.test", "policy.example.com"}, rejected)
+		assert.Len(t, pebble.Orders(accountURL), 1, "should not create orders")
+	})
+
+	t.Run("lego", func(t *testing.T) {
+		_, err := LegoClient(pebble, user).Certificate.Obtain(certificate.ObtainRequest{
+			Domains: []string{"blocked.policy.test"},
+		})
+		AssertProblem(t, err, "rejectedIdentifier")
+	})
+
+	t.Run("replayed", func(t *testing.T) {
+		resp, _ := signedNewAuthz(t, pebble, user, Identifier{Type: "dns", Value: "blocked.policy.test"},
+			"testacme", pebble.Server().URL+pebbleNewAuthzPath)
+		prob, err := ParseProblem(resp)
+		require.NoError(t, err)
+		assert.Equal(t, acmeErrorNS+"badNonce", prob.Type, "should check the nonce first")
+	})
+
+	t.Run("problem", func(t *testing.T) {
+		resp, _ := postNewAuthz(t, pebble, user, Identifier{Type: "ip", Value: "10.0.0.1"})
+		prob, err := ParseProblem(resp)
+		require.NoError(t, err)
+		assert.Equal(t, acmeErrorNS+"rejectedIdentifier", prob.Type)
+		assert.Contains(t, prob.Detail, "private address")
+		if assert.Len(t, prob.Subproblems, 1) {
+			assert.Equal(t, acmeErrorNS+"unsupportedIdentifier", prob.Subproblems[0].Type)
+			assert.Equal(t, ProblemIdentifier{Type: "ip", Value: "10.0.0.1"}, prob.Subproblems[0].Identifier)
+		}
+	})
+}
+
+func TestIdentifierPolicies(t *testing.T) {
+	assert.NoError(t, TestTLDPolicy(Identifier{Type: "dns", Value: "*.foo.test"}))
+	assert.NoError(t, TestTLDPolicy(Identifier{Type: "ip", Value: "127.0.0.1"}), "should permit IP addresses")
+	assert.Error(t, TestTLDPolicy(Identifier{Type: "dns", Value: "foo.latest"}))
+
+	deny := DenyListPolicy("blocked.test", "127.0.0.1")
+	assert.Error(t, deny(Identifier{Type: "dns", Value: "BLOCKED.test."}))
+	assert.Error(t, deny(Identifier{Type: "ip", Value: "127.0.0.1"}))
+	assert.NoError(t, deny(Identifier{Type: "dns", Value: "sub.blocked.test"}), "should only deny exact values")
+
+	deny = DenyListPolicy("::1")
+	assert.Error(t, deny(Identifier{Type: "ip", Value: "0::1"}), "should compare IP addresses")
+	assert.Error(t, deny(Identifier{Type: "ip", Value: "0:0:0:0:0:0:0:1"}))
+	assert.NoError(t, deny(Identifier{Type: "ip", Value: "::2"}))
+
+	denyRegexp := DenyRegexpPolicy(regexp.MustCompile(`(^|\.)internal\.test$`))
+	assert.Error(t, denyRegexp(Identifier{Type: "dns", Value: "DB.Internal.test."}), "should match normalized values")
+	assert.NoError(t, denyRegexp(Identifier{Type: "dns", Value: "internal.test.example"}))
+
+	assert.Panics(t, func() {
+		NewPebble(NewTestingContext(t), WithPebbleIdentifierPolicy(nil))
+	})
+}
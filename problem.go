@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"testing"
+
+	legoacme "github.com/go-acme/lego/v4/acme"
+)
+
+// acmeErrorNS is the namespace of ACME problem types.
+const acmeErrorNS = "urn:ietf:params:acme:error:"
+
+// problemContentType is the media type of problem documents.
+const problemContentType = "application/problem+json"
+
+// Problem is an ACME problem document, as sent by the server in error
+// responses.
+//
+// https://www.rfc-editor.org/rfc/rfc8555.html#section-6.7
+type Problem struct {
+	// Type is the problem type, eg:
+	// `urn:ietf:params:acme:error:rejectedIdentifier`.
+	Type string `json:"type"`
+	// Detail is the server's description of the problem.
+	Detail string `json:"detail,omitempty"`
+	// Status is the HTTP status code of the response.
+	Status int `json:"status,omitempty"`
+	// Subproblems are the problems with specific identifiers, for compound
+	// problems.
+	Subproblems []Subproblem `json:"subproblems,omitempty"`
+}
+
+// Subproblem is a problem with a specific identifier.
+//
+// https://www.rfc-editor.org/rfc/rfc8555.html#section-6.7.1
+type Subproblem struct {
+	Type       string            `json:"type"`
+	Detail     string            `json:"detail,omitempty"`
+	Identifier ProblemIdentifier `json:"identifier"`
+}
+
+// ProblemIdentifier is the identifier a Subproblem relates to.
+type ProblemIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func (p *Problem) Error() string {
+	msg := fmt.Sprintf("acme problem (%d): %s: %s", p.Status, p.Type, p.Detail)
+	for _, sub := range p.Subproblems {
+		msg += fmt.Sprintf(", %s %q: %s: %s", sub.Identifier.Type, sub.Identifier.Value, sub.Type, sub.Detail)
+	}
+	return msg
+}
+
+// ParseProblem reads the problem document from the response, for use with raw
+// HTTP clients. An error is returned when the response doesn't have a problem
+// document.
+func ParseProblem(resp *http.Response) (*Problem, error) {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != problemContentType {
+		return nil, fmt.Errorf("response is not a problem document: %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read problem document: %w", err)
+	}
+
+	var prob Problem
+	if err := json.Unmarshal(body, &prob); err != nil {
+		return nil, fmt.Errorf("decode problem document: %w", err)
+	}
+	if prob.Status == 0 {
+		prob.Status = resp.StatusCode
+	}
+
+	return &prob, nil
+}
+
+// AsProblem finds the ACME problem in the error's chain, as returned by
+// ParseProblem, lego, or testacme helpers (eg: Revoke). Lego's per-domain
+// failures (as returned by `Certificate.Obtain` for failed authorizations)
+// can't be unwrapped, as of lego v4.10, so their problems aren't found.
+func AsProblem(err error) (*Problem, bool) {
+	if err == nil {
+		return nil, false
+	}
+
+	var prob *Problem
+	if errors.As(err, &prob) {
+		return prob, true
+	}
+
+	var legoProb *legoacme.ProblemDetails
+	if errors.As(err, &legoProb) {
+		return fromLegoProblem(legoProb), true
+	}
+
+	var nonceErr *legoacme.NonceError
+	if errors.As(err, &nonceErr) && nonceErr.ProblemDetails != nil {
+		return fromLegoProblem(nonceErr.ProblemDetails), true
+	}
+
+	return nil, false
+}
+
+func fromLegoProblem(legoProb *legoacme.ProblemDetails) *Problem {
+	prob := &Problem{
+		Type:   legoProb.Type,
+		Detail: legoProb.Detail,
+		Status: legoProb.HTTPStatus,
+	}
+	for _, sub := range legoProb.SubProblems {
+		prob.Subproblems = append(prob.Subproblems, Subproblem{
+			Type:   sub.Type,
+			Detail: sub.Detail,
+			Identifier: ProblemIdentifier{
+				Type:  sub.Identifier.Type,
+				Value: sub.Identifier.Value,
+			},
+		})
+	}
+	return prob
+}
+
+// AssertProblem asserts that the error is an ACME problem of the given type, eg:
+// `urn:ietf:params:acme:error:rejectedIdentifier`. The `urn:ietf:params:acme:error:`
+// namespace may be omitted.
+func AssertProblem(t testing.TB, err error, problemType string) bool {
+	t.Helper()
+
+	if err == nil {
+		t.Errorf("expected problem %s, got no error", problemType)
+		return false
+	}
+
+	prob, ok := AsProblem(err)
+	if !ok {
+		t.Errorf("expected problem %s, got error: %v", problemType, err)
+		return false
+	}
+
+	if !strings.HasPrefix(problemType, "urn:") {
+		problemType = acmeErrorNS + problemType
+	}
+	if prob.Type != problemType {
+		t.Errorf("expected problem %s, got %v", problemType, prob)
+		return false
+	}
+
+	return true
+}
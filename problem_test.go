@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ignoredProvider doesn't present challenges, so that validation fails.
+type ignoredProvider struct{}
+
+func (ignoredProvider) Present(domain, token, keyAuth string) error { return nil }
+func (ignoredProvider) CleanUp(domain, token, keyAuth string) error { return nil }
+
+func TestProblem(t *testing.T) {
+	pebble := SharedPebble()
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+
+	t.Run("http", func(t *testing.T) {
+		resp, err := pebble.Client().Post(pebble.Server().URL+pebbleNewOrderPath, "application/jose+json", strings.NewReader("{}"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		prob, err := ParseProblem(resp)
+		require.NoError(t, err)
+		assert.Equal(t, acmeErrorNS+"malformed", prob.Type)
+		assert.Equal(t, http.StatusBadRequest, prob.Status)
+		assert.NotEmpty(t, prob.Detail)
+
+		AssertProblem(t, fmt.Errorf("wrapped: %w", prob), "urn:ietf:params:acme:error:malformed")
+		AssertProblem(t, prob, "malformed")
+	})
+
+	t.Run("not a problem", func(t *testing.T) {
+		resp, err := pebble.Client().Get(pebble.ACMEDirectoryURL())
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		_, err = ParseProblem(resp)
+		assert.Error(t, err)
+
+		_, ok := AsProblem(errors.New("not a problem"))
+		assert.False(t, ok)
+		_, ok = AsProblem(nil)
+		assert.False(t, ok)
+	})
+
+	t.Run("lego", func(t *testing.T) {
+		_, err := LegoAPIClient(pebble, user).Orders.New([]string{"trailing.problem.test."})
+		AssertProblem(t, err, "urn:ietf:params:acme:error:malformed")
+	})
+
+	t.Run("lego obtain", func(t *testing.T) {
+		client := LegoClient(pebble, user)
+		client.Challenge.Remove(challenge.HTTP01)
+		require.NoError(t, client.Challenge.SetTLSALPN01Provider(ignoredProvider{}))
+
+		_, err := client.Certificate.Obtain(certificate.ObtainRequest{
+			Domains: []string{"unanswered.problem.test"},
+		})
+		require.Error(t, err)
+		// lego's per-domain errors can't be unwrapped to their problems.
+		_, ok := AsProblem(err)
+		assert.False(t, ok, "should not find problem in %v", err)
+	})
+}
@@ -0,0 +1,387 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letsencrypt/pebble/v2/acme"
+	"github.com/letsencrypt/pebble/v2/core"
+	"github.com/letsencrypt/pebble/v2/db"
+
+	"github.com/jahkeup/testacme/pkg/rfc6761"
+)
+
+// RateLimit permits Count events within any sliding Window. The limit isn't
+// enforced when Count is 0.
+type RateLimit struct {
+	Count  int
+	Window time.Duration
+}
+
+// RateLimits are the limits enforced by the ACME API, see WithPebbleRateLimits.
+// Registered domains are the names one label below the TLD, as with
+// `rfc6761.RegisteredDomain`, IP addresses are each counted on their own.
+type RateLimits struct {
+	// CertificatesPerRegisteredDomain limits certificates issued for names
+	// under each registered domain.
+	CertificatesPerRegisteredDomain RateLimit
+	// DuplicateCertificates limits certificates issued for the exact same set
+	// of names.
+	DuplicateCertificates RateLimit
+	// FailedValidations limits failed challenge validations, per account and
+	// name.
+	FailedValidations RateLimit
+	// NewOrdersPerAccount limits orders created by each account.
+	NewOrdersPerAccount RateLimit
+}
+
+// LetsEncryptRateLimits provides the limits enforced by Let's Encrypt's
+// production environment.
+//
+// https://letsencrypt.org/docs/rate-limits/
+func LetsEncryptRateLimits() RateLimits {
+	return RateLimits{
+		CertificatesPerRegisteredDomain: RateLimit{Count: 50, Window: 7 * 24 * time.Hour},
+		DuplicateCertificates:           RateLimit{Count: 5, Window: 7 * 24 * time.Hour},
+		FailedValidations:               RateLimit{Count: 5, Window: time.Hour},
+		NewOrdersPerAccount:             RateLimit{Count: 300, Window: 3 * time.Hour},
+	}
+}
+
+// pendingValidation is a challenge being validated, which may yet fail.
+type pendingValidation struct {
+	challenge *core.Challenge
+	account   string
+	name      string
+	at        time.Time
+}
+
+// rateLimiter enforces RateLimits on newOrder requests, counting the events
+// that lead up to them in the ACME API.
+type rateLimiter struct {
+	limits RateLimits
+	db     *db.MemoryStore
+	clock  *Clock
+
+	mu sync.Mutex
+	// events are the times of counted events, by limit and scope.
+	events map[string][]time.Time
+	// pending are validations, by challenge ID, not yet known to succeed or
+	// fail.
+	pending map[string]pendingValidation
+}
+
+func newRateLimiter(limits RateLimits, store *db.MemoryStore, clock *Clock) *rateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		db:      store,
+		clock:   clock,
+		events:  map[string][]time.Time{},
+		pending: map[string]pendingValidation{},
+	}
+}
+
+// Reset forgets all counted events, as though no limits were ever approached.
+func (rl *rateLimiter) Reset() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.events = map[string][]time.Time{}
+	rl.pending = map[string]pendingValidation{}
+}
+
+// record counts an event for the limit's key, made at the time.
+func (rl *rateLimiter) record(limit RateLimit, key string, at time.Time) {
+	if limit.Count == 0 {
+		return
+	}
+	rl.events[key] = append(rl.events[key], at)
+}
+
+// exceeded checks the limit for the key, providing the time to retry after
+// when exceeded.
+func (rl *rateLimiter) exceeded(limit RateLimit, key string, now time.Time) (time.Time, bool) {
+	if limit.Count == 0 {
+		return time.Time{}, false
+	}
+
+	var recent []time.Time
+	for _, at := range rl.events[key] {
+		if now.Sub(at) < limit.Window {
+			recent = append(recent, at)
+		}
+	}
+	rl.events[key] = recent
+
+	if len(recent) < limit.Count {
+		return time.Time{}, false
+	}
+	// a slot frees up once the oldest (counted) event leaves the window.
+	return recent[len(recent)-limit.Count].Add(limit.Window), true
+}
+
+// collectFailures counts the pending validations that have since failed.
+func (rl *rateLimiter) collectFailures() {
+	for id, pending := range rl.pending {
+		pending.challenge.RLock()
+		status := pending.challenge.Status
+		pending.challenge.RUnlock()
+
+		switch status {
+		case acme.StatusInvalid:
+			rl.record(rl.limits.FailedValidations, failedValidationsKey(pending.account, pending.name), pending.at)
+			delete(rl.pending, id)
+		case acme.StatusValid:
+			delete(rl.pending, id)
+		}
+	}
+}
+
+func failedValidationsKey(account, name string) string {
+	return "failed-validations:" + account + ":" + strings.ToLower(name)
+}
+
+func newOrdersKey(account string) string {
+	return "new-orders:" + account
+}
+
+func registeredDomainKey(name string) string {
+	if ip := net.ParseIP(name); ip != nil {
+		return "registered-domain:ip:" + ip.String()
+	}
+	return "registered-domain:" + rfc6761.RegisteredDomain(name)
+}
+
+func duplicateKey(names []string) string {
+	set := map[string]struct{}{}
+	for _, name := range names {
+		set[strings.ToLower(name)] = struct{}{}
+	}
+	unique := make([]string, 0, len(set))
+	for name := range set {
+		unique = append(unique, name)
+	}
+	sort.Strings(unique)
+	return "duplicate:" + strings.Join(unique, ",")
+}
+
+// check finds the first limit exceeded by a new order, if any.
+func (rl *rateLimiter) check(account string, names []string) (*acme.ProblemDetails, time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.collectFailures()
+	now := rl.clock.Now()
+
+	if retryAfter, ok := rl.exceeded(rl.limits.NewOrdersPerAccount, newOrdersKey(account), now); ok {
+		return rateLimitedProblem(fmt.Sprintf("too many new orders (%d) from this account in the last %s",
+			rl.limits.NewOrdersPerAccount.Count, rl.limits.NewOrdersPerAccount.Window), retryAfter), retryAfter
+	}
+	for _, name := range names {
+		if retryAfter, ok := rl.exceeded(rl.limits.FailedValidations, failedValidationsKey(account, name), now); ok {
+			return rateLimitedProblem(fmt.Sprintf("too many failed authorizations (%d) for %q in the last %s",
+				rl.limits.FailedValidations.Count, name, rl.limits.FailedValidations.Window), retryAfter), retryAfter
+		}
+	}
+	for _, name := range names {
+		if retryAfter, ok := rl.exceeded(rl.limits.CertificatesPerRegisteredDomain, registeredDomainKey(name), now); ok {
+			return rateLimitedProblem(fmt.Sprintf("too many certificates (%d) already issued for %q in the last %s",
+				rl.limits.CertificatesPerRegisteredDomain.Count, rfc6761.RegisteredDomain(name),
+				rl.limits.CertificatesPerRegisteredDomain.Window), retryAfter), retryAfter
+		}
+	}
+	if retryAfter, ok := rl.exceeded(rl.limits.DuplicateCertificates, duplicateKey(names), now); ok {
+		return rateLimitedProblem(fmt.Sprintf("too many certificates (%d) already issued for this exact set of identifiers in the last %s",
+			rl.limits.DuplicateCertificates.Count, rl.limits.DuplicateCertificates.Window), retryAfter), retryAfter
+	}
+
+	return nil, time.Time{}
+}
+
+func rateLimitedProblem(detail string, retryAfter time.Time) *acme.ProblemDetails {
+	return &acme.ProblemDetails{
+		Type:       acmeErrorNS + "rateLimited",
+		Detail:     fmt.Sprintf("%s: retry after %s", detail, retryAfter.UTC().Format(time.RFC3339)),
+		HTTPStatus: http.StatusTooManyRequests,
+	}
+}
+
+// recordOrder counts a new order for the account.
+func (rl *rateLimiter) recordOrder(account string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.record(rl.limits.NewOrdersPerAccount, newOrdersKey(account), rl.clock.Now())
+}
+
+// recordIssuance counts a certificate issued for the names.
+func (rl *rateLimiter) recordIssuance(names []string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.clock.Now()
+	domains := map[string]struct{}{}
+	for _, name := range names {
+		domains[registeredDomainKey(name)] = struct{}{}
+	}
+	for key := range domains {
+		rl.record(rl.limits.CertificatesPerRegisteredDomain, key, now)
+	}
+	rl.record(rl.limits.DuplicateCertificates, duplicateKey(names), now)
+}
+
+// recordValidation watches the challenge's validation for failure.
+func (rl *rateLimiter) recordValidation(challenge *core.Challenge) {
+	challenge.RLock()
+	authz := challenge.Authz
+	id := challenge.ID
+	challenge.RUnlock()
+	if authz == nil || authz.Order == nil {
+		return
+	}
+
+	authz.RLock()
+	name := authz.Identifier.Value
+	order := authz.Order
+	authz.RUnlock()
+	order.RLock()
+	account := order.AccountID
+	order.RUnlock()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if _, ok := rl.pending[id]; !ok {
+		rl.pending[id] = pendingValidation{
+			challenge: challenge,
+			account:   account,
+			name:      name,
+			at:        rl.clock.Now(),
+		}
+	}
+}
+
+// WrapHandler rejects new orders exceeding the limits with `rateLimited`
+// problems, and counts the events that limits apply to.
+func (rl *rateLimiter) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch {
+		case r.URL.Path == pebbleNewOrderPath:
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				sendProblem(w, acme.MalformedProblem("unable to read request body"))
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			// Only verified requests are counted, Pebble rejects the
+			// others.
+			signer, payload := verifiedJWS(rl.db, body)
+			if signer == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			account, names := signer.ID, newOrderNames(payload)
+			if prob, retryAfter := rl.check(account, names); prob != nil {
+				setReplayNonce(w, next)
+				seconds := int(retryAfter.Sub(rl.clock.Now()).Seconds()) + 1
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				sendProblem(w, prob)
+				return
+			}
+
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			if rec.status == http.StatusCreated {
+				rl.recordOrder(account)
+			}
+
+		case strings.HasPrefix(r.URL.Path, pebbleFinalizePath):
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			if rec.status == http.StatusOK {
+				if order := rl.db.GetOrderByID(path.Base(r.URL.Path)); order != nil {
+					var names []string
+					order.RLock()
+					for _, identifier := range order.Identifiers {
+						names = append(names, identifier.Value)
+					}
+					order.RUnlock()
+					rl.recordIssuance(names)
+				}
+			}
+
+		case strings.HasPrefix(r.URL.Path, pebbleChallengePath):
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			if rec.status == http.StatusOK {
+				if challenge := rl.db.GetChallengeByID(path.Base(r.URL.Path)); challenge != nil {
+					rl.recordValidation(challenge)
+				}
+			}
+
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// newOrderNames provides the identifier values in the (verified) newOrder
+// payload.
+func newOrderNames(payload []byte) []string {
+	var order acme.Order
+	if err := json.Unmarshal(payload, &order); err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, identifier := range order.Identifiers {
+		names = append(names, identifier.Value)
+	}
+	return names
+}
+
+// WithPebbleRateLimits enforces the rate limits on the ACME API, new orders
+// exceeding a limit are rejected with a `rateLimited` problem. Windows follow
+// the Clock, when set with WithPebbleClock. Also see `Pebble.ResetRateLimits()`.
+func WithPebbleRateLimits(limits RateLimits) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		for _, limit := range []RateLimit{
+			limits.CertificatesPerRegisteredDomain,
+			limits.DuplicateCertificates,
+			limits.FailedValidations,
+			limits.NewOrdersPerAccount,
+		} {
+			if limit.Count < 0 || (limit.Count > 0 && limit.Window <= 0) {
+				return fmt.Errorf("invalid rate limit: %d per %s", limit.Count, limit.Window)
+			}
+		}
+		pc.rateLimits = &limits
+		return nil
+	}
+}
+
+// ResetRateLimits forgets all events counted towards rate limits, set with
+// WithPebbleRateLimits.
+func (p Pebble) ResetRateLimits() {
+	if p.rateLimiter != nil {
+		p.rateLimiter.Reset()
+	}
+}
@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	acmeapi "github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithPebbleRateLimits(t *testing.T) {
+	clock := new(Clock)
+	pebble := NewPebble(NewTestingContext(t),
+		WithPebbleClock(clock),
+		WithPebbleRateLimits(RateLimits{
+			CertificatesPerRegisteredDomain: RateLimit{Count: 1, Window: time.Hour},
+			DuplicateCertificates:           RateLimit{Count: 1, Window: 24 * time.Hour},
+			FailedValidations:               RateLimit{Count: 1, Window: time.Hour},
+			NewOrdersPerAccount:             RateLimit{Count: 2, Window: time.Hour},
+		}))
+
+	t.Run("new orders", func(t *testing.T) {
+		t.Cleanup(pebble.ResetRateLimits)
+		api := LegoAPIClient(pebble, ManagedUser(TestNamedEmail(t)).MustRegister(pebble))
+
+		for i := 0; i < 2; i++ {
+			_, err := api.Orders.New([]string{"orders" + strconv.Itoa(i) + ".ratelimit.test"})
+			require.NoError(t, err)
+		}
+		_, err := api.Orders.New([]string{"orders.ratelimit.test"})
+		AssertProblem(t, err, "urn:ietf:params:acme:error:rateLimited")
+
+		other := LegoAPIClient(pebble, ManagedUser(TestNamedEmail(t)+".other").MustRegister(pebble))
+		_, err = other.Orders.New([]string{"orders.ratelimit.test"})
+		assert.NoError(t, err, "should limit per account")
+
+		pebble.ResetRateLimits()
+		_, err = api.Orders.New([]string{"orders.ratelimit.test"})
+		assert.NoError(t, err, "should reset limits")
+	})
+
+	t.Run("unverified", func(t *testing.T) {
+		t.Cleanup(pebble.ResetRateLimits)
+		user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+		api := LegoAPIClient(pebble, user)
+		for i := 0; i < 2; i++ {
+			_, err := api.Orders.New([]string{"unverified" + strconv.Itoa(i) + ".ratelimit.test"})
+			require.NoError(t, err)
+		}
+
+		// claims to be the rate limited account, but isn't signed by it.
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		forged, err := acmeapi.New(pebble.Client(), "testacme", pebble.ACMEDirectoryURL(), user.GetRegistration().URI, key)
+		require.NoError(t, err)
+		_, err = forged.Orders.New([]string{"unverified.ratelimit.test"})
+		AssertProblem(t, err, "urn:ietf:params:acme:error:malformed")
+	})
+
+	t.Run("certificates", func(t *testing.T) {
+		t.Cleanup(pebble.ResetRateLimits)
+		client := LegoClient(pebble, ManagedUser(TestNamedEmail(t)).MustRegister(pebble))
+
+		_, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"a.certificates.test"}})
+		require.NoError(t, err)
+
+		_, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"b.certificates.test"}})
+		AssertProblem(t, err, "urn:ietf:params:acme:error:rateLimited")
+		prob, _ := AsProblem(err)
+		require.NotNil(t, prob)
+		assert.Contains(t, prob.Detail, `"certificates.test"`, "should limit registered domain")
+
+		_, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"c.other-certificates.test"}})
+		assert.NoError(t, err)
+
+		clock.Advance(2 * time.Hour)
+		_, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"b.certificates.test"}})
+		assert.NoError(t, err, "should permit issuance after window")
+
+		_, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"c.other-certificates.test"}})
+		AssertProblem(t, err, "urn:ietf:params:acme:error:rateLimited")
+		prob, _ = AsProblem(err)
+		require.NotNil(t, prob)
+		assert.Contains(t, prob.Detail, "exact set", "should limit duplicates")
+	})
+
+	t.Run("failed validations", func(t *testing.T) {
+		t.Cleanup(pebble.ResetRateLimits)
+		user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+		client := LegoClient(pebble, user)
+		client.Challenge.Remove(challenge.HTTP01)
+		require.NoError(t, client.Challenge.SetTLSALPN01Provider(ignoredProvider{}))
+
+		_, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"failed.validations.test"}})
+		require.Error(t, err)
+
+		_, err = LegoAPIClient(pebble, user).Orders.New([]string{"failed.validations.test"})
+		AssertProblem(t, err, "urn:ietf:params:acme:error:rateLimited")
+		prob, _ := AsProblem(err)
+		require.NotNil(t, prob)
+		assert.True(t, strings.Contains(prob.Detail, "failed authorizations"), prob.Detail)
+	})
+}
+
+func TestRegisteredDomainKey(t *testing.T) {
+	assert.Equal(t, registeredDomainKey("a.example.test"), registeredDomainKey("b.example.test"))
+	assert.NotEqual(t, registeredDomainKey("10.0.0.1"), registeredDomainKey("192.168.0.1"),
+		"should not group IP addresses")
+	assert.Equal(t, registeredDomainKey("::1"), registeredDomainKey("0:0::1"), "should key IPs by address")
+}
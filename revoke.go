@@ -0,0 +1,346 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	legoacme "github.com/go-acme/lego/v4/acme"
+	acmeapi "github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/letsencrypt/pebble/v2/acme"
+	"github.com/letsencrypt/pebble/v2/core"
+	"github.com/letsencrypt/pebble/v2/db"
+)
+
+// RevocationReason is the reason code given when revoking a certificate.
+//
+// https://www.rfc-editor.org/rfc/rfc5280.html#section-5.3.1
+type RevocationReason uint
+
+const (
+	ReasonUnspecified          RevocationReason = 0
+	ReasonKeyCompromise        RevocationReason = 1
+	ReasonCACompromise         RevocationReason = 2
+	ReasonAffiliationChanged   RevocationReason = 3
+	ReasonSuperseded           RevocationReason = 4
+	ReasonCessationOfOperation RevocationReason = 5
+	ReasonCertificateHold      RevocationReason = 6
+	// 7 is unused, and rejected by Pebble.
+	ReasonRemoveFromCRL      RevocationReason = 8
+	ReasonPrivilegeWithdrawn RevocationReason = 9
+	ReasonAACompromise       RevocationReason = 10
+)
+
+const unusedRevocationReason = 7
+
+var (
+	// ErrAlreadyRevoked matches errors revoking a certificate that's already
+	// been revoked.
+	ErrAlreadyRevoked = errors.New("certificate already revoked")
+	// ErrUnauthorizedRevocation matches errors revoking a certificate with a
+	// key that isn't authorized to revoke it.
+	ErrUnauthorizedRevocation = errors.New("unauthorized to revoke certificate")
+)
+
+// RevocationError is returned by Revoke when the ACME server rejects the
+// request, with the server's problem. Use `errors.Is` with ErrAlreadyRevoked or
+// ErrUnauthorizedRevocation to check for those problems, the *Problem itself is
+// also found with `errors.As` (and AsProblem).
+type RevocationError struct {
+	*Problem
+}
+
+func (e *RevocationError) Error() string {
+	return "revocation rejected: " + e.Problem.Error()
+}
+
+// Unwrap provides the server's problem.
+func (e *RevocationError) Unwrap() error {
+	return e.Problem
+}
+
+// Is matches ErrAlreadyRevoked and ErrUnauthorizedRevocation by problem type.
+func (e *RevocationError) Is(target error) bool {
+	switch target {
+	case ErrAlreadyRevoked:
+		return e.Type == acmeErrorNS+"alreadyRevoked"
+	case ErrUnauthorizedRevocation:
+		return e.Type == acmeErrorNS+"unauthorized"
+	default:
+		return false
+	}
+}
+
+// RevocationKey is the key used to sign a revocation request, see AccountKey
+// and CertificateKey.
+type RevocationKey struct {
+	// kid is the account URL, requests are signed with an embedded JWK when
+	// empty.
+	kid string
+	key crypto.PrivateKey
+}
+
+// AccountKey signs revocation requests with the registered user's account key.
+// The account must have issued the certificate, or hold valid authorizations
+// for all of its names.
+func AccountKey(user registration.User) RevocationKey {
+	return RevocationKey{
+		kid: user.GetRegistration().URI,
+		key: user.GetPrivateKey(),
+	}
+}
+
+// CertificateKey signs revocation requests with the certificate's own private
+// key.
+func CertificateKey(key crypto.Signer) RevocationKey {
+	return RevocationKey{key: key}
+}
+
+// Revoke revokes the certificate through the ACME API, signing the request with
+// the key. Problems reported by the server are returned as *RevocationError.
+func Revoke(testacme TestACME, cert *x509.Certificate, key RevocationKey, reason RevocationReason) error {
+	apiclient, err := acmeapi.New(testacme.Client(), "testacme/Revoke", testacme.ACMEDirectoryURL(), key.kid, key.key)
+	if err != nil {
+		return fmt.Errorf("lego acme (api) client: %w", err)
+	}
+
+	code := uint(reason)
+	err = apiclient.Certificates.Revoke(legoacme.RevokeCertMessage{
+		Certificate: base64.RawURLEncoding.EncodeToString(cert.Raw),
+		Reason:      &code,
+	})
+
+	var prob *legoacme.ProblemDetails
+	if errors.As(err, &prob) {
+		return &RevocationError{Problem: fromLegoProblem(prob)}
+	}
+
+	return err
+}
+
+// ErrCertificateNotFound is returned for certificates unknown to the testacme
+// server.
+var ErrCertificateNotFound = errors.New("certificate not found")
+
+// CertificateStatus is the status of an issued certificate.
+type CertificateStatus struct {
+	// Revoked is set once the certificate has been revoked.
+	Revoked bool
+	// Reason is the reason the certificate was revoked for.
+	Reason RevocationReason
+}
+
+// Pebble and ExternalACME can be managed through their management API.
+var (
+	_ Manager = (*Pebble)(nil)
+	_ Manager = (*ExternalACME)(nil)
+)
+
+// CertificateStatus provides the certificate's status, as reported by the
+// management API.
+func (p Pebble) CertificateStatus(serial *big.Int) (CertificateStatus, error) {
+	server := p.ManagementServer()
+	return managementCertificateStatus(server.Client(), server.URL, serial)
+}
+
+// CertificateStatus provides the certificate's status, as reported by the
+// configured (Pebble compatible) management API.
+func (e *ExternalACME) CertificateStatus(serial *big.Int) (CertificateStatus, error) {
+	if e.config.ManagementURL == "" {
+		return CertificateStatus{}, errNoManagementURL
+	}
+	return managementCertificateStatus(e.client, e.config.ManagementURL, serial)
+}
+
+// managementCertificateStatus fetches the certificate's status from the
+// management API.
+func managementCertificateStatus(client *http.Client, managementURL string, serial *big.Int) (CertificateStatus, error) {
+	resp, err := client.Get(managementURL + pebbleCertStatusBySerialPath + serial.Text(16))
+	if err != nil {
+		return CertificateStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return CertificateStatus{}, ErrCertificateNotFound
+	default:
+		return CertificateStatus{}, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	var status struct {
+		Status string
+		Reason *uint
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return CertificateStatus{}, fmt.Errorf("decode status: %w", err)
+	}
+
+	switch status.Status {
+	case "Valid":
+		return CertificateStatus{}, nil
+	case "Revoked":
+		revoked := CertificateStatus{Revoked: true}
+		if status.Reason != nil {
+			revoked.Reason = RevocationReason(*status.Reason)
+		}
+		return revoked, nil
+	default:
+		return CertificateStatus{}, fmt.Errorf("unknown certificate status %q", status.Status)
+	}
+}
+
+// RevokeBySerial revokes the certificate through the management API.
+func (p Pebble) RevokeBySerial(serial *big.Int, reason RevocationReason) error {
+	server := p.ManagementServer()
+	return managementRevokeBySerial(server.Client(), server.URL, serial, reason)
+}
+
+// RevokeBySerial revokes the certificate through the configured management
+// API. Pebble's own management API can't revoke certificates, so this needs a
+// server that serves testacme's revocation endpoint.
+func (e *ExternalACME) RevokeBySerial(serial *big.Int, reason RevocationReason) error {
+	if e.config.ManagementURL == "" {
+		return errNoManagementURL
+	}
+	return managementRevokeBySerial(e.client, e.config.ManagementURL, serial, reason)
+}
+
+// managementRevokeBySerial revokes the certificate through the management API.
+func managementRevokeBySerial(client *http.Client, managementURL string, serial *big.Int, reason RevocationReason) error {
+	body, err := json.Marshal(map[string]uint{"reason": uint(reason)})
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(managementURL+pebbleRevokeBySerialPath+serial.Text(16),
+		"application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	prob, err := ParseProblem(resp)
+	if err != nil {
+		return err
+	}
+	return &RevocationError{Problem: prob}
+}
+
+// managedCertificateStatus provides the certificate's status from the testacme
+// server's Manager.
+func managedCertificateStatus(testacme TestACME, serial *big.Int) (CertificateStatus, error) {
+	manager, ok := testacme.(Manager)
+	if !ok {
+		return CertificateStatus{}, fmt.Errorf("%T does not provide certificate status", testacme)
+	}
+	return manager.CertificateStatus(serial)
+}
+
+// AssertRevoked asserts that the certificate with the given serial number has
+// been revoked for the reason, as reported by the testacme server's Manager.
+func AssertRevoked(t testing.TB, testacme TestACME, serial *big.Int, reason RevocationReason) bool {
+	t.Helper()
+
+	status, err := managedCertificateStatus(testacme, serial)
+	switch {
+	case err != nil:
+		t.Errorf("certificate %s status: %v", serial.Text(16), err)
+		return false
+	case !status.Revoked:
+		t.Errorf("certificate %s should be revoked, it is valid", serial.Text(16))
+		return false
+	case status.Reason != reason:
+		t.Errorf("certificate %s should be revoked with reason %d, revoked with reason %d", serial.Text(16), reason, status.Reason)
+		return false
+	}
+
+	return true
+}
+
+// AssertNotRevoked asserts that the certificate with the given serial number is
+// valid, as reported by the testacme server's Manager.
+func AssertNotRevoked(t testing.TB, testacme TestACME, serial *big.Int) bool {
+	t.Helper()
+
+	status, err := managedCertificateStatus(testacme, serial)
+	switch {
+	case err != nil:
+		t.Errorf("certificate %s status: %v", serial.Text(16), err)
+		return false
+	case status.Revoked:
+		t.Errorf("certificate %s should be valid, it is revoked", serial.Text(16))
+		return false
+	}
+
+	return true
+}
+
+// revokeBySerialHandler revokes certificates, by their (hex) serial number,
+// through the management API. Pebble (as of v2.4.0) only supports revocation
+// through ACME.
+//
+// An optional JSON body may give the revocation reason: `{"reason": 1}`.
+func revokeBySerialHandler(store *db.MemoryStore, tracker *objectTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			sendProblem(w, acme.MethodNotAllowed())
+			return
+		}
+
+		serial, ok := new(big.Int).SetString(strings.TrimPrefix(r.URL.Path, pebbleRevokeBySerialPath), 16)
+		if !ok {
+			sendProblem(w, acme.MalformedProblem("serial must be hex encoded"))
+			return
+		}
+
+		var req struct {
+			Reason *uint `json:"reason,omitempty"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				sendProblem(w, acme.MalformedProblem("Error unmarshaling revocation JSON body"))
+				return
+			}
+		}
+		if req.Reason != nil && (*req.Reason == unusedRevocationReason || RevocationReason(*req.Reason) > ReasonAACompromise) {
+			sendProblem(w, acme.BadRevocationReasonProblem(fmt.Sprintf("Invalid revocation reason: %d", *req.Reason)))
+			return
+		}
+
+		cert := store.GetCertificateBySerial(serial)
+		if cert == nil {
+			if store.GetRevokedCertificateBySerial(serial) != nil {
+				sendProblem(w, acme.AlreadyRevokedProblem("Certificate has already been revoked."))
+				return
+			}
+			sendProblem(w, acme.NotFoundProblem("Unable to find specified certificate."))
+			return
+		}
+
+		store.RevokeCertificate(&core.RevokedCertificate{
+			Certificate: cert,
+			RevokedAt:   time.Now(),
+			Reason:      req.Reason,
+		})
+		tracker.trackRevoked(serial)
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
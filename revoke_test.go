@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net/http"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevoke(t *testing.T) {
+	pebble := SharedPebble()
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+	client := LegoClient(pebble, user)
+
+	obtain := func(t *testing.T, domain string) (*x509.Certificate, crypto.Signer) {
+		key, err := certcrypto.GeneratePrivateKey(certcrypto.EC256)
+		require.NoError(t, err)
+		resource, err := client.Certificate.Obtain(certificate.ObtainRequest{
+			Domains:    []string{domain},
+			PrivateKey: key,
+		})
+		require.NoError(t, err)
+		cert, err := certcrypto.ParsePEMCertificate(resource.Certificate)
+		require.NoError(t, err)
+		return cert, key.(crypto.Signer)
+	}
+
+	t.Run("account key", func(t *testing.T) {
+		cert, _ := obtain(t, "account.revoke.test")
+		AssertNotRevoked(t, pebble, cert.SerialNumber)
+
+		require.NoError(t, Revoke(pebble, cert, AccountKey(user), ReasonSuperseded))
+		AssertRevoked(t, pebble, cert.SerialNumber, ReasonSuperseded)
+
+		err := Revoke(pebble, cert, AccountKey(user), ReasonSuperseded)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrAlreadyRevoked), "should be already revoked: %v", err)
+		assert.False(t, errors.Is(err, ErrUnauthorizedRevocation))
+
+		var revocationErr *RevocationError
+		require.True(t, errors.As(err, &revocationErr))
+		assert.Equal(t, http.StatusBadRequest, revocationErr.Status)
+		AssertProblem(t, err, "alreadyRevoked")
+	})
+
+	t.Run("certificate key", func(t *testing.T) {
+		cert, key := obtain(t, "certificate.revoke.test")
+
+		require.NoError(t, Revoke(pebble, cert, CertificateKey(key), ReasonKeyCompromise))
+		AssertRevoked(t, pebble, cert.SerialNumber, ReasonKeyCompromise)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		cert, _ := obtain(t, "unauthorized.revoke.test")
+
+		other := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+		err := Revoke(pebble, cert, AccountKey(other), ReasonUnspecified)
+		assert.True(t, errors.Is(err, ErrUnauthorizedRevocation), "should be unauthorized: %v", err)
+
+		key, err := certcrypto.GeneratePrivateKey(certcrypto.EC256)
+		require.NoError(t, err)
+		err = Revoke(pebble, cert, CertificateKey(key.(crypto.Signer)), ReasonUnspecified)
+		assert.True(t, errors.Is(err, ErrUnauthorizedRevocation), "should be unauthorized: %v", err)
+
+		AssertNotRevoked(t, pebble, cert.SerialNumber)
+	})
+
+	t.Run("management", func(t *testing.T) {
+		cert, _ := obtain(t, "management.revoke.test")
+
+		require.NoError(t, pebble.RevokeBySerial(cert.SerialNumber, ReasonCessationOfOperation))
+		AssertRevoked(t, pebble, cert.SerialNumber, ReasonCessationOfOperation)
+
+		err := pebble.RevokeBySerial(cert.SerialNumber, ReasonUnspecified)
+		assert.True(t, errors.Is(err, ErrAlreadyRevoked), "should be already revoked: %v", err)
+
+		_, err = pebble.CertificateStatus(big.NewInt(1))
+		assert.True(t, errors.Is(err, ErrCertificateNotFound), "should be unknown: %v", err)
+	})
+}
@@ -5,6 +5,7 @@ package testacme
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"sync"
 )
 
@@ -69,3 +70,46 @@ func SharedDNS() *DNS {
 
 	return sharedDNS
 }
+
+var (
+	sharedTLSALPN01RespondersMu sync.Mutex
+	sharedTLSALPN01Responders   = map[int]*TLSALPN01Responder{}
+)
+
+// SharedTLSALPN01Responder provides the shared tls-alpn-01 responder for the
+// given verification port, suitable for concurrent use. All callers solving
+// challenges on the same port get the same responder so that (for example)
+// parallel tests using SharedPebble don't fight over the verification port.
+func SharedTLSALPN01Responder(port int) *TLSALPN01Responder {
+	sharedTLSALPN01RespondersMu.Lock()
+	defer sharedTLSALPN01RespondersMu.Unlock()
+
+	responder, ok := sharedTLSALPN01Responders[port]
+	if !ok {
+		responder = NewTLSALPN01Responder("", strconv.Itoa(port))
+		sharedTLSALPN01Responders[port] = responder
+	}
+
+	return responder
+}
+
+var (
+	sharedHTTP01RespondersMu sync.Mutex
+	sharedHTTP01Responders   = map[int]*HTTP01Responder{}
+)
+
+// SharedHTTP01Responder provides the shared http-01 responder for the given
+// verification port, suitable for concurrent use. All callers solving
+// challenges on the same port get the same responder.
+func SharedHTTP01Responder(port int) *HTTP01Responder {
+	sharedHTTP01RespondersMu.Lock()
+	defer sharedHTTP01RespondersMu.Unlock()
+
+	responder, ok := sharedHTTP01Responders[port]
+	if !ok {
+		responder = NewHTTP01Responder("", strconv.Itoa(port))
+		sharedHTTP01Responders[port] = responder
+	}
+
+	return responder
+}
@@ -6,14 +6,11 @@ import (
 	"context"
 	"crypto"
 	"fmt"
-	"strconv"
 	"strings"
 	"testing"
 
 	acmeapi "github.com/go-acme/lego/v4/acme/api"
 	"github.com/go-acme/lego/v4/certcrypto"
-	"github.com/go-acme/lego/v4/challenge/http01"
-	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
 	"github.com/go-acme/lego/v4/lego"
 	"github.com/go-acme/lego/v4/registration"
 )
@@ -58,10 +55,10 @@ func LegoClient(testacme TestACME, user registration.User) *lego.Client {
 		panic(fmt.Sprintf("failed to get lego client: %v", err))
 	}
 
-	client.Challenge.SetTLSALPN01Provider(tlsalpn01.NewProviderServer("",
-		strconv.Itoa(testacme.TLSVerificationPort())))
-	client.Challenge.SetHTTP01Provider(http01.NewProviderServer("",
-		strconv.Itoa(testacme.HTTPVerificationPort())))
+	// tls-alpn-01 is preferred by lego when offered, the shared responder
+	// permits concurrent use of the verification port.
+	client.Challenge.SetTLSALPN01Provider(SharedTLSALPN01Responder(testacme.TLSVerificationPort()))
+	client.Challenge.SetHTTP01Provider(SharedHTTP01Responder(testacme.HTTPVerificationPort()))
 
 	return client
 }
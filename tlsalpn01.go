@@ -0,0 +1,318 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+)
+
+// tlsALPN01HandshakeTimeout bounds the time spent on any one verification
+// connection.
+const tlsALPN01HandshakeTimeout = 10 * time.Second
+
+// TLSALPN01Responder answers tls-alpn-01 challenges for any number of
+// identifiers on a single listener. The `acme-tls/1` certificate is selected
+// by the SNI sent by the verifier, so concurrent tests may share the one
+// verification port as long as they solve challenges for distinct names.
+//
+// Connections for names registered with a backend are relayed to the backend
+// instead, see RegisterBackend.
+//
+// The listener is bound when the first certificate is registered and closed
+// once the last certificate is deregistered - the port is only held while
+// challenges are actually in flight.
+type TLSALPN01Responder struct {
+	addr string
+
+	mu       sync.Mutex
+	certs    map[string]getCertificateFunc
+	backends map[string]string
+	listener net.Listener
+}
+
+// getCertificateFunc provides the challenge certificate for a verification
+// connection.
+type getCertificateFunc = func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// TLSALPN01Responder is usable as a lego challenge provider.
+var _ challenge.Provider = (*TLSALPN01Responder)(nil)
+
+// NewTLSALPN01Responder creates a responder that will listen on the given
+// interface and port. Prefer SharedTLSALPN01Responder when responding to
+// challenges from a shared testacme instance.
+func NewTLSALPN01Responder(iface, port string) *TLSALPN01Responder {
+	return &TLSALPN01Responder{
+		addr:     net.JoinHostPort(iface, port),
+		certs:    map[string]getCertificateFunc{},
+		backends: map[string]string{},
+	}
+}
+
+// Addr returns the address the responder listens on (or will listen on, when
+// not yet started).
+func (r *TLSALPN01Responder) Addr() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.listener != nil {
+		return r.listener.Addr().String()
+	}
+	return r.addr
+}
+
+// Register adds the challenge certificate to be served for the given name, or
+// IP address (served by its reverse-DNS SNI). Names may only be registered
+// once at a time, an error is returned when the name is already registered by
+// another caller.
+func (r *TLSALPN01Responder) Register(name string, cert *tls.Certificate) error {
+	if cert == nil {
+		return errors.New("nil challenge certificate")
+	}
+
+	return r.RegisterFunc(name, func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cert, nil
+	})
+}
+
+// RegisterFunc adds the function providing challenge certificates for the
+// given name, eg: `autocert.Manager.GetCertificate`. Names may only be
+// registered once at a time, an error is returned when the name is already
+// registered by another caller.
+func (r *TLSALPN01Responder) RegisterFunc(name string, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) error {
+	if getCertificate == nil {
+		return errors.New("nil challenge certificate func")
+	}
+	key := tlsALPN01Key(name)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.reserve(name, key); err != nil {
+		return err
+	}
+	r.certs[key] = getCertificate
+
+	return nil
+}
+
+// RegisterBackend relays verification connections for the given name, by
+// SNI, to the backend address, where another server answers the challenge.
+// Names may only be registered once at a time, an error is returned when the
+// name is already registered by another caller.
+func (r *TLSALPN01Responder) RegisterBackend(name, backend string) error {
+	if _, _, err := net.SplitHostPort(backend); err != nil {
+		return fmt.Errorf("invalid backend address %q: %w", backend, err)
+	}
+	key := tlsALPN01Key(name)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.reserve(name, key); err != nil {
+		return err
+	}
+	r.backends[key] = backend
+
+	return nil
+}
+
+// reserve checks that the name isn't yet registered, and binds the listener
+// for its registration. Callers must hold r.mu.
+func (r *TLSALPN01Responder) reserve(name, key string) error {
+	if _, exists := r.certs[key]; exists {
+		return fmt.Errorf("challenge certificate already registered for %q", name)
+	}
+	if _, exists := r.backends[key]; exists {
+		return fmt.Errorf("backend already registered for %q", name)
+	}
+
+	if r.listener == nil {
+		l, err := net.Listen("tcp", r.addr)
+		if err != nil {
+			return fmt.Errorf("listen for tls-alpn-01 challenges: %w", err)
+		}
+		r.listener = l
+		go r.serve(l)
+	}
+
+	return nil
+}
+
+// Deregister removes the challenge certificate, or backend, for the given
+// name. The listener is closed when nothing remains registered.
+func (r *TLSALPN01Responder) Deregister(name string) {
+	key := tlsALPN01Key(name)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.certs, key)
+	delete(r.backends, key)
+
+	if len(r.certs) == 0 && len(r.backends) == 0 && r.listener != nil {
+		r.listener.Close()
+		r.listener = nil
+	}
+}
+
+// Present implements challenge.Provider
+func (r *TLSALPN01Responder) Present(domain, token, keyAuth string) error {
+	cert, err := TLSALPN01ChallengeCert(domain, keyAuth)
+	if err != nil {
+		return fmt.Errorf("challenge cert: %w", err)
+	}
+
+	return r.Register(domain, cert)
+}
+
+// CleanUp implements challenge.Provider
+func (r *TLSALPN01Responder) CleanUp(domain, token, keyAuth string) error {
+	r.Deregister(domain)
+	return nil
+}
+
+// getCertificate selects the registered challenge certificate by SNI.
+func (r *TLSALPN01Responder) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	getCertificate, ok := r.certs[tlsALPN01Key(hello.ServerName)]
+	r.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no challenge certificate for %q", hello.ServerName)
+	}
+	return getCertificate(hello)
+}
+
+func (r *TLSALPN01Responder) serve(l net.Listener) {
+	config := &tls.Config{
+		GetCertificate: r.getCertificate,
+		NextProtos:     []string{tlsalpn01.ACMETLS1Protocol},
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// closed by Deregister
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(tlsALPN01HandshakeTimeout))
+
+			serverName, hello, err := peekServerName(conn)
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			backend, routed := r.backends[tlsALPN01Key(serverName)]
+			r.mu.Unlock()
+			if routed {
+				conn.SetDeadline(time.Time{})
+				proxyTLS(conn, hello, backend)
+				return
+			}
+
+			// verifiers only inspect the handshake, there's nothing more to
+			// serve after that.
+			tls.Server(&replayConn{Conn: conn, replay: bytes.NewReader(hello)}, config).Handshake()
+		}()
+	}
+}
+
+// tlsALPN01Key normalizes names for lookup in the registry. IP addresses are
+// looked up by their reverse-DNS name, as sent in the SNI by verifiers.
+func tlsALPN01Key(name string) string {
+	if ip := net.ParseIP(name); ip != nil {
+		return reverseDNSName(ip)
+	}
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// idPeACMEIdentifier is the OID of the acmeIdentifier extension holding the
+// key authorization digest.
+//
+// https://www.rfc-editor.org/rfc/rfc8737.html#section-6.1
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// TLSALPN01ChallengeCert creates the `acme-tls/1` challenge certificate for the
+// identifier, a DNS name or IP address. Certificates for IP addresses have the
+// address as their only SAN, lego's (as of v4.10) only have DNS names.
+//
+// https://www.rfc-editor.org/rfc/rfc8738.html#section-6
+func TLSALPN01ChallengeCert(identifier, keyAuth string) (*tls.Certificate, error) {
+	ip := net.ParseIP(identifier)
+	if ip == nil {
+		return tlsalpn01.ChallengeCert(identifier, keyAuth)
+	}
+
+	digest := sha256.Sum256([]byte(keyAuth))
+	value, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: "testacme tls-alpn-01"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		IPAddresses:  []net.IP{ip},
+		ExtraExtensions: []pkix.Extension{{
+			Id:       idPeACMEIdentifier,
+			Critical: true,
+			Value:    value,
+		}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// reverseDNSName provides the `in-addr.arpa` or `ip6.arpa` name of the IP
+// address, without the trailing dot, as used for the SNI of tls-alpn-01
+// verification connections.
+//
+// https://www.rfc-editor.org/rfc/rfc8738.html#section-6
+func reverseDNSName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	ip6 := ip.To16()
+	labels := make([]string, 0, 2*len(ip6)+1)
+	for i := len(ip6) - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%x.%x", ip6[i]&0x0f, ip6[i]>>4))
+	}
+	labels = append(labels, "ip6.arpa")
+	return strings.Join(labels, ".")
+}
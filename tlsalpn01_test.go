@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jahkeup/testacme/pkg/randomports"
+)
+
+func TestTLSALPN01Responder(t *testing.T) {
+	port, err := randomports.One()
+	require.NoError(t, err)
+	responder := NewTLSALPN01Responder("127.0.0.1", port.String())
+
+	fooCert, err := tlsalpn01.ChallengeCert("foo.test", "foo-key-auth")
+	require.NoError(t, err)
+	barCert, err := tlsalpn01.ChallengeCert("bar.test", "bar-key-auth")
+	require.NoError(t, err)
+
+	require.NoError(t, responder.Register("foo.test", fooCert))
+	require.NoError(t, responder.Register("bar.test", barCert))
+	assert.Error(t, responder.Register("FOO.test.", fooCert), "should not register the same name twice")
+	assert.Error(t, responder.RegisterBackend("foo.test", "127.0.0.1:1"), "should not route a registered name")
+
+	for name, expected := range map[string]*tls.Certificate{"foo.test": fooCert, "bar.test": barCert} {
+		conn, err := tls.Dial("tcp", responder.Addr(), &tls.Config{
+			ServerName:         name,
+			NextProtos:         []string{tlsalpn01.ACMETLS1Protocol},
+			InsecureSkipVerify: true,
+		})
+		require.NoError(t, err, "should handshake for %q", name)
+		cs := conn.ConnectionState()
+		conn.Close()
+
+		assert.Equal(t, tlsalpn01.ACMETLS1Protocol, cs.NegotiatedProtocol)
+		if assert.NotEmpty(t, cs.PeerCertificates) {
+			assert.Equal(t, expected.Certificate[0], cs.PeerCertificates[0].Raw, "should select certificate by SNI")
+		}
+	}
+
+	responder.Deregister("foo.test")
+	_, err = tls.Dial("tcp", responder.Addr(), &tls.Config{
+		ServerName:         "foo.test",
+		NextProtos:         []string{tlsalpn01.ACMETLS1Protocol},
+		InsecureSkipVerify: true,
+	})
+	assert.Error(t, err, "deregistered names should not be served")
+
+	responder.Deregister("bar.test")
+	_, err = tls.Dial("tcp", responder.Addr(), &tls.Config{
+		ServerName:         "bar.test",
+		NextProtos:         []string{tlsalpn01.ACMETLS1Protocol},
+		InsecureSkipVerify: true,
+	})
+	assert.Error(t, err, "listener should be closed with no registrations")
+}
+
+func TestSharedPebble_TLSALPN01Parallel(t *testing.T) {
+	pebble := SharedPebble()
+
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("parallel-%d.tlsalpn01.test", i)
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+			client := LegoClient(pebble, user)
+
+			cert, err := client.Certificate.Obtain(certificate.ObtainRequest{
+				Domains: []string{name},
+			})
+			assert.NoError(t, err)
+			assert.NotNil(t, cert)
+		})
+	}
+}
+
+func TestTLSALPN01ChallengeCert_IP(t *testing.T) {
+	port, err := randomports.One()
+	require.NoError(t, err)
+	responder := NewTLSALPN01Responder("", port.String())
+
+	for ip, serverName := range map[string]string{
+		"127.0.0.1": "1.0.0.127.in-addr.arpa.",
+		"::1":       "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.",
+	} {
+		require.NoError(t, responder.Present(ip, "token", "key-auth"))
+
+		// as Pebble's VA connects for IP identifiers.
+		conn, err := tls.Dial("tcp", net.JoinHostPort(ip, port.String()), &tls.Config{
+			ServerName:         serverName,
+			NextProtos:         []string{tlsalpn01.ACMETLS1Protocol},
+			InsecureSkipVerify: true,
+		})
+		require.NoError(t, err, "should handshake for %q", ip)
+		cs := conn.ConnectionState()
+		conn.Close()
+
+		if assert.NotEmpty(t, cs.PeerCertificates) {
+			leaf := cs.PeerCertificates[0]
+			assert.Empty(t, leaf.DNSNames)
+			if assert.Len(t, leaf.IPAddresses, 1) {
+				assert.True(t, leaf.IPAddresses[0].Equal(net.ParseIP(ip)), "should have the IP address SAN")
+			}
+		}
+
+		require.NoError(t, responder.CleanUp(ip, "token", "key-auth"))
+	}
+}
@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certificate"
+)
+
+// NewTLSServer starts an HTTPS server for the handler, serving a certificate
+// for the names obtained from the testacme server. The server's URL uses the
+// first name, which must not be a wildcard, and its `Client()` trusts the
+// testacme roots and resolves names through the testacme DNS (the DNS answers
+// with the loopback address by default). The system roots are trusted instead
+// when the testacme server isn't a RootProvider. The server is closed at the
+// end of the test.
+func NewTLSServer(t testing.TB, testacme TestACME, handler http.Handler, names ...string) *httptest.Server {
+	t.Helper()
+
+	if len(names) == 0 {
+		t.Fatal("no names given for TLS server certificate")
+	}
+	if strings.HasPrefix(names[0], "*.") {
+		t.Fatalf("first name %q is used for the TLS server URL, so cannot be a wildcard", names[0])
+	}
+
+	user := ManagedUser(TestNamedEmail(t))
+	if err := user.Register(testacme); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	resource, err := LegoClient(testacme, user).Certificate.Obtain(certificate.ObtainRequest{
+		Domains: names,
+		Bundle:  true,
+	})
+	if err != nil {
+		t.Fatalf("obtain certificate for %q: %v", names, err)
+	}
+	cert, err := tls.X509KeyPair(resource.Certificate, resource.PrivateKey)
+	if err != nil {
+		t.Fatalf("certificate key pair: %v", err)
+	}
+
+	roots, err := trustedRoots(testacme)
+	if err != nil {
+		t.Fatalf("testacme roots: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	server.URL = "https://" + net.JoinHostPort(names[0], port)
+
+	// the client is owned by the server, replace its trust of the server's
+	// own certificate with the testacme roots.
+	server.Client().Transport = newTransport(roots, dnsResolver(testacme))
+
+	return server
+}
+
+// Transport provides an HTTP transport trusting the testacme roots (or the
+// system roots, when the testacme server isn't a RootProvider), and resolving
+// names through the nameserver. The nameserver used by the testacme server for
+// verification is used when nameserver is nil. An error is returned when the
+// testacme roots can't be provided.
+func Transport(testacme TestACME, nameserver *DNS) (*http.Transport, error) {
+	roots, err := trustedRoots(testacme)
+	if err != nil {
+		return nil, fmt.Errorf("testacme roots: %w", err)
+	}
+
+	resolver := dnsResolver(testacme)
+	if nameserver != nil {
+		resolver = nameserver.Resolver()
+	}
+
+	return newTransport(roots, resolver), nil
+}
+
+func newTransport(roots *x509.CertPool, resolver *net.Resolver) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	transport.DialContext = (&net.Dialer{Resolver: resolver}).DialContext
+	return transport
+}
+
+// trustedRoots provides the testacme Root CA certificates, nil is provided
+// (to use the system roots) when the testacme server isn't a RootProvider.
+func trustedRoots(testacme TestACME) (*x509.CertPool, error) {
+	provider, ok := testacme.(RootProvider)
+	if !ok {
+		return nil, nil
+	}
+	return provider.Roots()
+}
+
+// dnsResolver provides a resolver querying the nameserver used by the testacme
+// server for verification.
+func dnsResolver(testacme TestACME) *net.Resolver {
+	switch pebble := testacme.(type) {
+	case Pebble:
+		return nameserverResolver(pebble.PebbleServerConfig.VerificationDNSResolver)
+	case *Pebble:
+		return nameserverResolver(pebble.PebbleServerConfig.VerificationDNSResolver)
+	}
+	return SharedDNS().Resolver()
+}
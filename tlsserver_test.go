@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTLSServer(t *testing.T) {
+	pebble := SharedPebble()
+	server := NewTLSServer(t, pebble, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.TLS.ServerName))
+	}), "app.tlsserver.test", "www.tlsserver.test")
+
+	require.Contains(t, server.URL, "https://app.tlsserver.test:")
+	resp, err := server.Client().Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello app.tlsserver.test", string(body))
+	require.NotEmpty(t, resp.TLS.VerifiedChains, "should verify against testacme roots")
+	assert.Equal(t, []string{"app.tlsserver.test", "www.tlsserver.test"}, resp.TLS.PeerCertificates[0].DNSNames)
+
+	_, err = http.Get(server.URL)
+	assert.Error(t, err, "should need testacme DNS and roots")
+	transport, err := Transport(pebble, nil)
+	require.NoError(t, err)
+	client := &http.Client{Transport: transport}
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err, "should reach server with testacme transport")
+	resp.Body.Close()
+
+	t.Run("wildcard", func(t *testing.T) {
+		tb := &fatalTB{TB: t}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			NewTLSServer(tb, pebble, http.NotFoundHandler(), "*.wildcard.tlsserver.test")
+		}()
+		<-done
+		assert.Contains(t, tb.fatal, "cannot be a wildcard")
+	})
+}
+
+// fatalTB records the first fatal error and stops the calling goroutine, as
+// FailNow does.
+type fatalTB struct {
+	testing.TB
+	fatal string
+}
+
+func (f *fatalTB) Helper() {}
+func (f *fatalTB) Fatalf(format string, args ...interface{}) {
+	f.fatal = fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+func TestDNSResolver(t *testing.T) {
+	ctx := NewTestingContext(t)
+	db := new(NameserverDB)
+	db.StoreExact(*DNSRRMsg(MustRR("app.resolver.tlsserver.test. 300 IN A 127.0.0.2")))
+	srv, err := NewDNS(ctx, db)
+	require.NoError(t, err)
+	pebble := NewPebble(ctx, WithPebbleDNS(srv))
+
+	for name, testacme := range map[string]TestACME{"value": pebble, "pointer": &pebble} {
+		addrs, err := dnsResolver(testacme).LookupHost(ctx, "app.resolver.tlsserver.test")
+		require.NoError(t, err, name)
+		assert.Equal(t, []string{"127.0.0.2"}, addrs, "should resolve through the %s's nameserver", name)
+	}
+}
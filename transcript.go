@@ -0,0 +1,267 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/pebble/v2/acme"
+)
+
+// TranscriptEntry is a request to the ACME API and its response.
+type TranscriptEntry struct {
+	Time     time.Time    `json:"time"`
+	Method   string       `json:"method"`
+	Path     string       `json:"path"`
+	Endpoint ACMEEndpoint `json:"endpoint,omitempty"`
+	// Protected is the request's decoded JWS protected header, if any.
+	Protected json.RawMessage `json:"protected,omitempty"`
+	// Payload is the request's decoded JWS payload, if any. POST-as-GET
+	// requests have an empty payload.
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Status  int             `json:"status"`
+	// Problem is the response's problem document, if any.
+	Problem *Problem `json:"problem,omitempty"`
+}
+
+func (e TranscriptEntry) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s -> %d", e.Time.Format("15:04:05.000"), e.Method, e.Path, e.Status)
+	if len(e.Protected) > 0 {
+		fmt.Fprintf(&b, "\n  protected: %s", e.Protected)
+	}
+	if len(e.Payload) > 0 {
+		fmt.Fprintf(&b, "\n  payload: %s", e.Payload)
+	}
+	if e.Problem != nil {
+		fmt.Fprintf(&b, "\n  problem: %s: %s", e.Problem.Type, e.Problem.Detail)
+	}
+	return b.String()
+}
+
+// Transcript is the record of requests to the ACME API, oldest first.
+type Transcript []TranscriptEntry
+
+func (t Transcript) String() string {
+	entries := make([]string, len(t))
+	for i, entry := range t {
+		entries[i] = entry.String()
+	}
+	return strings.Join(entries, "\n")
+}
+
+// WriteJSONLines writes the transcript with one JSON encoded entry per line.
+func (t Transcript) WriteJSONLines(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, entry := range t {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultTranscriptLimit is the number of entries kept in the transcript when
+// not set with WithPebbleTranscriptLimit.
+const defaultTranscriptLimit = 1000
+
+// transcriptRecorder records the requests to, and responses from, the ACME API.
+// Only the most recent entries, up to the limit, are kept.
+type transcriptRecorder struct {
+	clock *Clock
+	limit int
+
+	mu      sync.Mutex
+	entries Transcript
+	// dropped is the number of entries discarded from the front of entries.
+	dropped int
+}
+
+// Transcript provides the entries recorded since the given index, that are
+// still kept.
+func (tr *transcriptRecorder) Transcript(since int) Transcript {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	since -= tr.dropped
+	if since < 0 {
+		since = 0
+	}
+	if since > len(tr.entries) {
+		since = len(tr.entries)
+	}
+	return append(Transcript(nil), tr.entries[since:]...)
+}
+
+// Len provides the number of entries recorded, including those since
+// discarded.
+func (tr *transcriptRecorder) Len() int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	return tr.dropped + len(tr.entries)
+}
+
+// add records the entry, discarding the oldest entry when over the limit.
+func (tr *transcriptRecorder) add(entry TranscriptEntry) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.entries = append(tr.entries, entry)
+	if over := len(tr.entries) - tr.limit; over > 0 {
+		// copied, so the discarded entries aren't held by the backing
+		// array.
+		tr.entries = append(make(Transcript, 0, tr.limit), tr.entries[over:]...)
+		tr.dropped += over
+	}
+}
+
+// WrapHandler records each request and its response.
+func (tr *transcriptRecorder) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := TranscriptEntry{
+			Time:     tr.clock.Now(),
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Endpoint: requestEndpoint(r),
+		}
+
+		if r.Body != nil {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				sendProblem(w, acme.MalformedProblem("unable to read request body"))
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			entry.Protected, entry.Payload = decodeJWS(body)
+		}
+
+		rec := &transcriptResponseWriter{ResponseWriter: w}
+		defer func() {
+			entry.Status = rec.status
+			if rec.problem.Len() > 0 {
+				var prob Problem
+				if json.Unmarshal(rec.problem.Bytes(), &prob) == nil {
+					entry.Problem = &prob
+				}
+			}
+
+			tr.add(entry)
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// decodeJWS provides the decoded protected header and payload of the
+// (flattened JSON) JWS, without verifying it. Payloads that aren't JSON are
+// given as a JSON string.
+func decodeJWS(body []byte) (json.RawMessage, json.RawMessage) {
+	var signed acme.JSONSigned
+	if err := json.Unmarshal(body, &signed); err != nil {
+		return nil, nil
+	}
+
+	decode := func(s string) json.RawMessage {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil
+		}
+		if !json.Valid(b) {
+			b, _ = json.Marshal(string(b))
+		}
+		return b
+	}
+
+	return decode(signed.Protected), decode(signed.Payload)
+}
+
+// transcriptResponseWriter records the response status, and the body when it's
+// a problem document.
+type transcriptResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	problem bytes.Buffer
+}
+
+func (tw *transcriptResponseWriter) WriteHeader(status int) {
+	if tw.status == 0 {
+		tw.status = status
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *transcriptResponseWriter) Write(p []byte) (int, error) {
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	if mediaType, _, _ := mime.ParseMediaType(tw.Header().Get("Content-Type")); mediaType == problemContentType {
+		tw.problem.Write(p)
+	}
+	return tw.ResponseWriter.Write(p)
+}
+
+// Hijack permits faults to drop the connection.
+func (tw *transcriptResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := tw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer cannot be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// WithPebbleTranscriptLimit sets the number of requests to the ACME API, and
+// their responses, kept for Transcript and LogTranscriptOnFailure - the oldest
+// are discarded beyond the limit. Every request is recorded by default, with
+// the most recent 1000 kept. A limit of 0 disables recording.
+func WithPebbleTranscriptLimit(limit int) PebbleOption {
+	return func(pc *pebbleConfig) error {
+		if limit < 0 {
+			return fmt.Errorf("invalid transcript limit %d", limit)
+		}
+		pc.transcriptLimit = &limit
+		return nil
+	}
+}
+
+// Transcript provides the record of requests made to the ACME API, and their
+// responses, see WithPebbleTranscriptLimit.
+func (p Pebble) Transcript() Transcript {
+	if p.transcript == nil {
+		return nil
+	}
+	return p.transcript.Transcript(0)
+}
+
+// LogTranscriptOnFailure logs the requests made to the ACME API during the
+// test, and their responses, if the test fails.
+func LogTranscriptOnFailure(t testing.TB, pebble Pebble) {
+	if pebble.transcript == nil {
+		t.Cleanup(func() {
+			if t.Failed() {
+				t.Logf("ACME transcript not recorded, see WithPebbleTranscriptLimit")
+			}
+		})
+		return
+	}
+
+	since := pebble.transcript.Len()
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("ACME transcript:\n%s", pebble.transcript.Transcript(since))
+		}
+	})
+}
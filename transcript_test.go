@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failedTB reports failure and collects logs, for checking behavior of failed
+// tests.
+type failedTB struct {
+	testing.TB
+	cleanups []func()
+	logs     []string
+}
+
+func (f *failedTB) Failed() bool      { return true }
+func (f *failedTB) Cleanup(fn func()) { f.cleanups = append(f.cleanups, fn) }
+func (f *failedTB) Logf(format string, args ...interface{}) {
+	f.logs = append(f.logs, fmt.Sprintf(format, args...))
+}
+
+func TestPebble_Transcript(t *testing.T) {
+	pebble := NewPebble(NewTestingContext(t))
+	tb := &failedTB{TB: t}
+	LogTranscriptOnFailure(tb, pebble)
+
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+	api := LegoAPIClient(pebble, user)
+	_, err := api.Orders.New([]string{"transcript.test"})
+	require.NoError(t, err)
+	_, err = api.Orders.New([]string{"trailing.transcript.test."})
+	require.Error(t, err)
+
+	transcript := pebble.Transcript()
+	var orders []TranscriptEntry
+	for _, entry := range transcript {
+		// Pebble rejects some nonces at random, lego retries those.
+		if entry.Endpoint == EndpointNewOrder &&
+			(entry.Problem == nil || entry.Problem.Type != acmeErrorNS+"badNonce") {
+			orders = append(orders, entry)
+		}
+	}
+	require.Len(t, orders, 2)
+
+	created := orders[0]
+	assert.Equal(t, http.MethodPost, created.Method)
+	assert.Equal(t, pebbleNewOrderPath, created.Path)
+	assert.Equal(t, http.StatusCreated, created.Status)
+	assert.Nil(t, created.Problem)
+	var protected struct {
+		KeyID string `json:"kid"`
+		Nonce string `json:"nonce"`
+	}
+	require.NoError(t, json.Unmarshal(created.Protected, &protected))
+	assert.Equal(t, user.GetRegistration().URI, protected.KeyID)
+	assert.NotEmpty(t, protected.Nonce)
+	assert.Contains(t, string(created.Payload), "transcript.test")
+
+	rejected := orders[1]
+	assert.Equal(t, http.StatusBadRequest, rejected.Status)
+	require.NotNil(t, rejected.Problem)
+	assert.Equal(t, acmeErrorNS+"malformed", rejected.Problem.Type)
+
+	var buf bytes.Buffer
+	require.NoError(t, transcript.WriteJSONLines(&buf))
+	lines := 0
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var entry TranscriptEntry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		lines++
+	}
+	assert.Equal(t, len(transcript), lines)
+
+	for _, cleanup := range tb.cleanups {
+		cleanup()
+	}
+	require.Len(t, tb.logs, 1, "should log transcript of failed test")
+	assert.Contains(t, tb.logs[0], "POST "+pebbleNewOrderPath+" -> 201")
+	assert.Contains(t, tb.logs[0], "urn:ietf:params:acme:error:malformed")
+
+	t.Run("limit", func(t *testing.T) {
+		pebble := NewPebble(NewTestingContext(t), WithPebbleTranscriptLimit(2))
+		tb := &failedTB{TB: t}
+		LogTranscriptOnFailure(tb, pebble)
+
+		for i := 0; i < 3; i++ {
+			resp, err := pebble.Client().Get(pebble.ACMEDirectoryURL())
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+		assert.Len(t, pebble.Transcript(), 2, "should keep the most recent entries")
+
+		for _, cleanup := range tb.cleanups {
+			cleanup()
+		}
+		require.Len(t, tb.logs, 1)
+		assert.Equal(t, 2, strings.Count(tb.logs[0], "GET "), "should log the entries kept")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		pebble := NewPebble(NewTestingContext(t), WithPebbleTranscriptLimit(0))
+		tb := &failedTB{TB: t}
+		LogTranscriptOnFailure(tb, pebble)
+
+		ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+		assert.Nil(t, pebble.Transcript(), "should not record with a limit of 0")
+
+		for _, cleanup := range tb.cleanups {
+			cleanup()
+		}
+		require.Len(t, tb.logs, 1)
+		assert.Contains(t, tb.logs[0], "WithPebbleTranscriptLimit")
+	})
+}
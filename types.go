@@ -3,6 +3,8 @@
 package testacme
 
 import (
+	"crypto/x509"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 )
@@ -32,3 +34,37 @@ type Porter interface {
 	// verification.
 	TLSVerificationPort() int
 }
+
+// The following interfaces are optional extensions of TestACME, implemented by
+// some testacme servers. Helpers check for them with a type assertion and
+// degrade (or report that they can't be used) when a server doesn't implement
+// them.
+
+// RootProvider describes testacme servers that provide the Root CA
+// certificates of their issued certificates' chains.
+type RootProvider interface {
+	// Roots provides the Root CA certificates, of every chain.
+	Roots() (*x509.CertPool, error)
+}
+
+// Manager describes testacme servers that can be managed outside of the ACME
+// API.
+type Manager interface {
+	// AddExternalAccountKey adds the MAC key used to bind accounts to the
+	// external account keyID.
+	AddExternalAccountKey(keyID string, key []byte) error
+	// RevokeBySerial revokes the certificate with the serial number, without
+	// an ACME request. Problems are returned as *RevocationError.
+	RevokeBySerial(serial *big.Int, reason RevocationReason) error
+	// CertificateStatus provides the status of the certificate with the
+	// serial number, ErrCertificateNotFound is returned for unknown
+	// certificates.
+	CertificateStatus(serial *big.Int) (CertificateStatus, error)
+}
+
+// ClockController describes testacme servers whose time can be controlled.
+type ClockController interface {
+	// Clock provides the Clock used by the server, the server uses the
+	// system clock when nil.
+	Clock() *Clock
+}
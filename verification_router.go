@@ -0,0 +1,196 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// verificationRouteTimeout bounds the time spent connecting to a routed
+// backend.
+const verificationRouteTimeout = 10 * time.Second
+
+// verificationRouter routes verification connections, made by the testacme VA
+// to its fixed verification ports, to per-hostname backend addresses. HTTP
+// requests are routed by their Host header and TLS connections by their SNI.
+//
+// Routes are registered on the SharedHTTP01Responder and
+// SharedTLSALPN01Responder for the ports, so that routed hosts and challenges
+// answered by the responders (as LegoClient does) share the one port.
+type verificationRouter struct {
+	http *HTTP01Responder
+	tls  *TLSALPN01Responder
+
+	mu sync.Mutex
+	// httpHosts and tlsHosts are the hosts routed on the shared responders
+	// by this router.
+	httpHosts map[string]struct{}
+	tlsHosts  map[string]struct{}
+}
+
+func newVerificationRouter(httpPort, tlsPort int) *verificationRouter {
+	return &verificationRouter{
+		http:      SharedHTTP01Responder(httpPort),
+		tls:       SharedTLSALPN01Responder(tlsPort),
+		httpHosts: map[string]struct{}{},
+		tlsHosts:  map[string]struct{}{},
+	}
+}
+
+// RouteHTTP routes HTTP requests for host to the backend address.
+func (vr *verificationRouter) RouteHTTP(host, backend string) error {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+
+	if err := vr.http.RegisterBackend(host, backend); err != nil {
+		return err
+	}
+	vr.httpHosts[routeKey(host)] = struct{}{}
+
+	return nil
+}
+
+// RouteTLS routes TLS connections for host to the backend address.
+func (vr *verificationRouter) RouteTLS(host, backend string) error {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+
+	if err := vr.tls.RegisterBackend(host, backend); err != nil {
+		return err
+	}
+	vr.tlsHosts[tlsALPN01Key(host)] = struct{}{}
+
+	return nil
+}
+
+// Remove stops routing connections for host, on all ports.
+func (vr *verificationRouter) Remove(host string) {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+
+	// only hosts routed here are deregistered, the host may otherwise be
+	// registered on the shared responders by another caller.
+	if _, ok := vr.httpHosts[routeKey(host)]; ok {
+		vr.http.DeregisterBackend(host)
+		delete(vr.httpHosts, routeKey(host))
+	}
+	if _, ok := vr.tlsHosts[tlsALPN01Key(host)]; ok {
+		vr.tls.Deregister(host)
+		delete(vr.tlsHosts, tlsALPN01Key(host))
+	}
+}
+
+// Close stops routing connections on all ports.
+func (vr *verificationRouter) Close() {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+
+	for host := range vr.httpHosts {
+		vr.http.DeregisterBackend(host)
+	}
+	vr.httpHosts = map[string]struct{}{}
+
+	for host := range vr.tlsHosts {
+		vr.tls.Deregister(host)
+	}
+	vr.tlsHosts = map[string]struct{}{}
+}
+
+// routeKey normalizes hostnames (optionally with a port) for route lookups. IP
+// addresses are keyed by their reverse-DNS name, so that TLS connections are
+// routed by the SNI sent for them.
+func routeKey(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return reverseDNSName(ip)
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// proxyTLS relays the TLS connection, whose ClientHello has already been read,
+// to the backend address.
+func proxyTLS(conn net.Conn, hello []byte, backend string) {
+	upstream, err := net.DialTimeout("tcp", backend, verificationRouteTimeout)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	if _, err := upstream.Write(hello); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(upstream, conn); done <- struct{}{} }()
+	go func() { io.Copy(conn, upstream); done <- struct{}{} }()
+	<-done
+}
+
+// errServerNamePeeked aborts the handshake used to parse the ClientHello.
+var errServerNamePeeked = errors.New("server name peeked")
+
+// peekServerName reads the TLS ClientHello from conn and returns the requested
+// SNI along with the bytes read, which must be replayed to the eventual
+// handshake peer.
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var (
+		serverName string
+		peeked     bool
+	)
+	recorder := &recordingConn{Conn: conn}
+
+	err := tls.Server(recorder, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName, peeked = hello.ServerName, true
+			return nil, errServerNamePeeked
+		},
+	}).Handshake()
+	if !peeked {
+		if err == nil {
+			err = errors.New("handshake completed without a ClientHello")
+		}
+		return "", nil, err
+	}
+
+	return serverName, recorder.buf.Bytes(), nil
+}
+
+// recordingConn records everything read from the connection and discards
+// writes, permitting a handshake to be inspected without disturbing the peer.
+type recordingConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.buf.Write(p[:n])
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// replayConn replays bytes already read from the connection, eg: a peeked
+// ClientHello, ahead of the rest of the connection.
+type replayConn struct {
+	net.Conn
+	replay io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	if n, err := c.replay.Read(p); n > 0 || err != io.EOF {
+		return n, err
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jahkeup/testacme/pkg/randomports"
+)
+
+func TestPebble_VerificationRouting(t *testing.T) {
+	pebble := NewPebble(NewTestingContext(t))
+
+	t.Run("http-01", func(t *testing.T) {
+		obtainRoutedHTTP(t, pebble, "http-service.routing.test")
+	})
+
+	t.Run("tls-alpn-01", func(t *testing.T) {
+		for _, host := range []string{"service-a.routing.test", "service-b.routing.test"} {
+			host := host
+			t.Run(host, func(t *testing.T) {
+				t.Parallel()
+				obtainRoutedTLS(t, pebble, host)
+			})
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		const host = "duplicate.routing.test"
+
+		require.NoError(t, pebble.RouteHTTPVerification(host, "127.0.0.1:1"))
+		require.NoError(t, pebble.RouteTLSVerification(host, "127.0.0.1:1"))
+		t.Cleanup(func() { pebble.RemoveVerificationRoutes(host) })
+
+		assert.Error(t, pebble.RouteHTTPVerification(host, "127.0.0.1:2"), "should not replace the existing route")
+		assert.Error(t, pebble.RouteTLSVerification(host, "127.0.0.1:2"), "should not replace the existing route")
+	})
+
+	t.Run("shared responder", func(t *testing.T) {
+		shared := SharedPebble()
+
+		t.Run("routed http-01", func(t *testing.T) {
+			t.Parallel()
+			obtainRoutedHTTP(t, shared, "routed-http.shared.routing.test")
+		})
+		t.Run("routed tls-alpn-01", func(t *testing.T) {
+			t.Parallel()
+			obtainRoutedTLS(t, shared, "routed.shared.routing.test")
+		})
+		for _, kind := range []challenge.Type{challenge.HTTP01, challenge.TLSALPN01} {
+			kind := kind
+			t.Run("responder "+string(kind), func(t *testing.T) {
+				t.Parallel()
+				user := ManagedUser(TestNamedEmail(t)).MustRegister(shared)
+				client := LegoClient(shared, user)
+				if kind == challenge.HTTP01 {
+					client.Challenge.Remove(challenge.TLSALPN01)
+				} else {
+					client.Challenge.Remove(challenge.HTTP01)
+				}
+
+				_, err := client.Certificate.Obtain(certificate.ObtainRequest{
+					Domains: []string{string(kind) + ".responder.shared.routing.test"},
+				})
+				assert.NoError(t, err, "should share the verification port with routes")
+			})
+		}
+	})
+}
+
+// obtainRoutedHTTP obtains a certificate for host, answering its http-01
+// challenge from a backend routed to by the Pebble.
+func obtainRoutedHTTP(t *testing.T, pebble Pebble, host string) {
+	port, err := randomports.One()
+	require.NoError(t, err)
+
+	require.NoError(t, pebble.RouteHTTPVerification(host, net.JoinHostPort("127.0.0.1", port.String())))
+	t.Cleanup(func() { pebble.RemoveVerificationRoutes(host) })
+
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+	client := LegoClient(pebble, user)
+	client.Challenge.Remove(challenge.TLSALPN01)
+	require.NoError(t, client.Challenge.SetHTTP01Provider(http01.NewProviderServer("127.0.0.1", port.String())))
+
+	cert, err := client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{host},
+	})
+	assert.NoError(t, err, "should obtain certificate for %q", host)
+	assert.NotNil(t, cert)
+}
+
+// obtainRoutedTLS obtains a certificate for host, answering its tls-alpn-01
+// challenge from a backend routed to by the Pebble.
+func obtainRoutedTLS(t *testing.T, pebble Pebble, host string) {
+	port, err := randomports.One()
+	require.NoError(t, err)
+
+	require.NoError(t, pebble.RouteTLSVerification(host, net.JoinHostPort("127.0.0.1", port.String())))
+	t.Cleanup(func() { pebble.RemoveVerificationRoutes(host) })
+
+	user := ManagedUser(TestNamedEmail(t)).MustRegister(pebble)
+	client := LegoClient(pebble, user)
+	client.Challenge.Remove(challenge.HTTP01)
+	require.NoError(t, client.Challenge.SetTLSALPN01Provider(tlsalpn01.NewProviderServer("127.0.0.1", port.String())))
+
+	cert, err := client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{host},
+	})
+	assert.NoError(t, err, "should obtain certificate for %q", host)
+	assert.NotNil(t, cert)
+}
@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// XCryptoClient provides a `golang.org/x/crypto/acme` client for the testacme
+// server, using the given account key.
+func XCryptoClient(testacme TestACME, key crypto.Signer) *acme.Client {
+	return &acme.Client{
+		Key:          key,
+		HTTPClient:   testacme.Client(),
+		DirectoryURL: testacme.ACMEDirectoryURL(),
+		UserAgent:    "testacme/XCryptoClient",
+	}
+}
+
+// AutocertManager provides an `autocert.Manager` obtaining certificates for the
+// hosts from the testacme server, with a newly generated account key.
+//
+// The manager answers tls-alpn-01 challenges through the
+// SharedTLSALPN01Responder on the TLSVerificationPort. The hosts are
+// registered with the responder until the test ends, as with NewTLSServer, and
+// the test fails when another caller has any of them registered.
+func AutocertManager(t testing.TB, testacme TestACME, hosts ...string) *autocert.Manager {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate account key: %v", err)
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Client:     XCryptoClient(testacme, key),
+	}
+
+	responder := SharedTLSALPN01Responder(testacme.TLSVerificationPort())
+	for i, host := range hosts {
+		if err := responder.RegisterFunc(host, manager.GetCertificate); err != nil {
+			for _, registered := range hosts[:i] {
+				responder.Deregister(registered)
+			}
+			t.Fatalf("register tls-alpn-01 responder: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, host := range hosts {
+			responder.Deregister(host)
+		}
+	})
+
+	return manager
+}
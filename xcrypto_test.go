@@ -0,0 +1,212 @@
+// SPDX-License-Identifier: MIT OR LGPL-3.0-or-later
+
+package testacme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+)
+
+func TestXCryptoClient(t *testing.T) {
+	pebble := SharedPebble()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	client := XCryptoClient(pebble, key)
+	ctx := NewTestingContext(t)
+
+	dir, err := client.Discover(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, pebble.Server().URL+pebbleNewOrderPath, dir.OrderURL)
+
+	account, err := client.Register(ctx, &acme.Account{Contact: []string{"mailto:" + TestNamedEmail(t)}}, acme.AcceptTOS)
+	require.NoError(t, err)
+	assert.Equal(t, acme.StatusValid, account.Status)
+}
+
+func TestAutocertManager(t *testing.T) {
+	const host = "autocert.xcrypto.test"
+	pebble := SharedPebble()
+
+	manager := AutocertManager(t, pebble, host)
+
+	tb := &fatalTB{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		AutocertManager(tb, pebble, host)
+	}()
+	<-done
+	assert.Contains(t, tb.fatal, "register", "should not register hosts twice")
+
+	cert, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, []string{host}, leaf.DNSNames)
+
+	_, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.xcrypto.test"})
+	assert.Error(t, err, "should only get certificates for hosts")
+
+	t.Run("cleanup", func(t *testing.T) {
+		const host = "cleanup.autocert.xcrypto.test"
+		t.Run("first", func(t *testing.T) {
+			AutocertManager(t, pebble, host)
+		})
+		// fails the test unless deregistered when the first test ended.
+		AutocertManager(t, pebble, host)
+	})
+}
+
+func TestIPIdentifiers(t *testing.T) {
+	pebble := NewPebble(NewTestingContext(t))
+
+	for _, kind := range []ChallengeKind{ChallengeHTTP01, ChallengeTLSALPN01} {
+		kind := kind
+		t.Run(string(kind), func(t *testing.T) {
+			for name, identifiers := range map[string][]string{
+				"ip":    {"127.0.0.1", "::1"},
+				"mixed": {string(kind) + ".mixed.xcrypto.test", "127.0.0.1"},
+			} {
+				cert, err := xcryptoObtainCertificate(NewTestingContext(t), pebble, kind, identifiers...)
+				require.NoError(t, err, "should obtain %s certificate", name)
+
+				var names []string
+				names = append(names, cert.Leaf.DNSNames...)
+				for _, ip := range cert.Leaf.IPAddresses {
+					names = append(names, ip.String())
+				}
+				assert.ElementsMatch(t, identifiers, names)
+			}
+		})
+	}
+
+	t.Run("dns-01", func(t *testing.T) {
+		_, err := xcryptoObtainCertificate(NewTestingContext(t), pebble, ChallengeDNS01, "127.0.0.1")
+		assert.Error(t, err, "should only support http-01 and tls-alpn-01")
+	})
+}
+
+// xcryptoObtainCertificate obtains a certificate for the identifiers, DNS names
+// or IP addresses, from the testacme server with an XCryptoClient registered
+// with a newly generated account key. IP addresses are ordered as `ip`
+// identifiers (RFC 8738), which LegoClient can't order as of lego v4.10.
+//
+// Authorizations are answered with challenges of the kind, either `http-01`
+// or `tls-alpn-01`, through the SharedHTTP01Responder or
+// SharedTLSALPN01Responder on the verification ports.
+func xcryptoObtainCertificate(ctx context.Context, testacme TestACME, kind ChallengeKind, identifiers ...string) (*tls.Certificate, error) {
+	var present func(identifier, token, keyAuth string) error
+	var cleanUp func(identifier, token, keyAuth string) error
+	switch kind {
+	case ChallengeHTTP01:
+		responder := SharedHTTP01Responder(testacme.HTTPVerificationPort())
+		present, cleanUp = responder.Present, responder.CleanUp
+	case ChallengeTLSALPN01:
+		responder := SharedTLSALPN01Responder(testacme.TLSVerificationPort())
+		present, cleanUp = responder.Present, responder.CleanUp
+	default:
+		return nil, fmt.Errorf("unsupported challenge kind %q", kind)
+	}
+
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate account key: %w", err)
+	}
+	client := XCryptoClient(testacme, accountKey)
+	if _, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS); err != nil {
+		return nil, fmt.Errorf("register: %w", err)
+	}
+
+	csr := &x509.CertificateRequest{}
+	var ids []acme.AuthzID
+	for _, identifier := range identifiers {
+		if ip := net.ParseIP(identifier); ip != nil {
+			ids = append(ids, acme.IPIDs(identifier)...)
+			csr.IPAddresses = append(csr.IPAddresses, ip)
+		} else {
+			ids = append(ids, acme.DomainIDs(identifier)...)
+			csr.DNSNames = append(csr.DNSNames, identifier)
+		}
+	}
+
+	order, err := client.AuthorizeOrder(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("new order: %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return nil, fmt.Errorf("get authorization: %w", err)
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+
+		var chal *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == string(kind) {
+				chal = c
+			}
+		}
+		if chal == nil {
+			return nil, fmt.Errorf("no %s challenge for %s %q", kind, authz.Identifier.Type, authz.Identifier.Value)
+		}
+
+		// the key authorization is the same for all challenge types.
+		keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+		if err := present(authz.Identifier.Value, chal.Token, keyAuth); err != nil {
+			return nil, fmt.Errorf("present %s challenge: %w", kind, err)
+		}
+		defer cleanUp(authz.Identifier.Value, chal.Token, keyAuth)
+
+		if _, err := client.Accept(ctx, chal); err != nil {
+			return nil, fmt.Errorf("accept challenge: %w", err)
+		}
+		if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+			return nil, fmt.Errorf("authorize %s %q: %w", authz.Identifier.Type, authz.Identifier.Value, err)
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, fmt.Errorf("wait order: %w", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate certificate key: %w", err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, csr, certKey)
+	if err != nil {
+		return nil, fmt.Errorf("create csr: %w", err)
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csrDER, true)
+	if err != nil {
+		return nil, fmt.Errorf("finalize order: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+
+	return &tls.Certificate{
+		Certificate: chain,
+		PrivateKey:  certKey,
+		Leaf:        leaf,
+	}, nil
+}